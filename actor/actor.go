@@ -3,126 +3,262 @@ package actor
 import (
 	"aquarium/ai"
 	"aquarium/logger"
-	"bytes"
+	"aquarium/sandbox"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"context"
-	"math/rand"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 
 	"time"
 )
 
+// keepRecentCommands is how many of the latest commands stay verbatim in the
+// prompt when older history is compacted into the progress summary
+const keepRecentCommands = 5
+
+// longRunningTimeoutFactor scales the command timeout for commands the AI
+// expects to run for a long time, such as large downloads or builds
+const longRunningTimeoutFactor = 5
+
+// exitStatusFile is where the terminal's PROMPT_COMMAND writes the last exit code
+const exitStatusFile = "/tmp/last.status"
+
+// processPollInterval is how often a running command is checked through /proc,
+// in case it ends without a prompt marker, e.g. because it killed the shell
+const processPollInterval = 5 * time.Second
+
+// promptMarker is an OSC escape the terminal's PROMPT_COMMAND prints before
+// every prompt, carrying the exit code of the command that just finished.
+// Terminals ignore unknown OSC sequences, and ReadTerminalOut strips it.
+var (
+	promptMarker      = regexp.MustCompile(`\x1b\]777;aquarium-done;(\d+)\x07`)
+	promptMarkerStrip = regexp.MustCompile(`(\x1b\])?777;aquarium-done;\d+\x07?`)
+)
+
+const promptMarkerMaxLength = 32
+
+// promptSettleDelay is how long to wait after a prompt marker before reading
+// the transcript, since the shell prints the prompt itself just after it
+const promptSettleDelay = 100 * time.Millisecond
+
+// firstPromptTimeout bounds the wait for a new terminal's shell to start
+const firstPromptTimeout = 10 * time.Second
+
 type Actor struct {
-	cli                   *client.Client
+	sandbox               sandbox.Sandbox
 	ctx                   context.Context
 	lastCommand           string
 	lastCommandOutput     string
+	lastExitCode          int
 	terminalStateString   string
 	terminalStateOutcomes []ai.CommandPair // [command: outcome, command: outcome, etc]
-	containerId           string
-	model                 string
-	url                   string
+	progressSummary       string           // rolling summary of terminalStateOutcomes[:compactedCount]
+	compactedCount        int
+	provider              ai.Provider
 	goal                  string
 	contextMode           string
+	conversation          bool
+	checkGoal             bool
+	verifyCommand         string
 	id                    string
 	iterationCount        int
 	iterationLimit        int
 	commandTimeoutSeconds int
-	terminalConnection    types.HijackedResponse
+	commandCount          int
+	maxTokens             int
+	maxCost               float64
+	maxDuration           time.Duration
+	tty                   io.ReadWriteCloser
+	prompts               chan int // exit codes from prompt markers, see watchPrompts
+	snapshotEvery         int
+	rollback              bool
+	lastSnapshot          *snapshot
+	lastVerifyExitCode    int          // -1 until the first verification after a command
+	rollbackNote          string       // added to the outcome of a command that was rolled back
+	restoreMu             sync.RWMutex // held while the sandbox is restored, so the transcript isn't read meanwhile
+	sessionDir            string
+	keepSnapshots         bool
+	fork                  *Step  // restored on start, when forked
+	resume                *State // reattached or restored on start, when resumed
+	forkOf                string
+	forkStep              int
 	quit                  chan struct{}
+	stopOnce              sync.Once
+
+	mu         sync.Mutex // guards the fields below, which Result reads from other goroutines
+	status     string
+	stopReason string
+	startTime  time.Time
+	endTime    time.Time
+	// resumedElapsed is how long the session ran before it was resumed
+	resumedElapsed time.Duration
+	verification   *Verification
+	rollbacks      int
+}
+
+// Config holds the per-run settings for an Actor
+type Config struct {
+	Goal                  string
+	ContextMode           string
+	IterationLimit        int
+	CommandTimeoutSeconds int
+	// Conversation sends the history as a multi-turn chat instead of one prompt
+	Conversation bool
+	// CheckGoal asks the AI after every command whether the goal is achieved
+	CheckGoal bool
+	// VerifyCommand is run in the container after every command and when the
+	// AI says it is done. Exit code 0 means the goal is achieved.
+	VerifyCommand string
+	// Budgets for the whole session. Zero means unlimited.
+	MaxTokens   int
+	MaxCost     float64
+	MaxDuration time.Duration
+	// SnapshotEvery saves the sandbox before every Nth command. Zero means never.
+	SnapshotEvery int
+	// Rollback restores the last snapshot when a destructive command fails or
+	// the verification exit code goes up
+	Rollback bool
+	// KeepSnapshots records a Step for every snapshot in SessionDir, so the
+	// session can be forked. The sandbox has to keep its snapshots too.
+	KeepSnapshots bool
+	// ID names the session. A random one is used when empty.
+	ID string
+	// SessionDir is where the session's state and steps are saved. Nothing is
+	// saved when empty.
+	SessionDir string
+	// Fork starts the session from a step of another one, restoring its
+	// snapshot and command history
+	Fork *Step
+	// Resume continues a session from its saved state, in the sandbox it left
+	// behind or else from its last snapshot. It keeps the session's ID.
+	Resume *State
 }
 
-func NewActor(model string, url string, goal string, contextMode string, iterationLimit int, commandTimeoutSeconds int) *Actor {
-	rand.Seed(time.Now().UnixNano())
-	id := fmt.Sprintf("%08x", rand.Uint32())
-
-	return &Actor{
-		model:                 model,
-		url:                   url,
-		goal:                  goal,
-		contextMode:           contextMode,
-		iterationLimit:        iterationLimit,
-		commandTimeoutSeconds: commandTimeoutSeconds,
+func NewActor(provider ai.Provider, sb sandbox.Sandbox, cfg Config) *Actor {
+	id := cfg.ID
+	if cfg.Resume != nil {
+		id = cfg.Resume.ID
+	}
+	if id == "" {
+		id = NewID()
+	}
+
+	a := &Actor{
+		provider:              provider,
+		sandbox:               sb,
+		ctx:                   context.Background(),
+		goal:                  cfg.Goal,
+		contextMode:           cfg.ContextMode,
+		conversation:          cfg.Conversation,
+		checkGoal:             cfg.CheckGoal,
+		verifyCommand:         cfg.VerifyCommand,
+		iterationLimit:        cfg.IterationLimit,
+		commandTimeoutSeconds: cfg.CommandTimeoutSeconds,
+		maxTokens:             cfg.MaxTokens,
+		maxCost:               cfg.MaxCost,
+		maxDuration:           cfg.MaxDuration,
+		snapshotEvery:         cfg.SnapshotEvery,
+		rollback:              cfg.Rollback,
+		lastVerifyExitCode:    -1,
+		sessionDir:            cfg.SessionDir,
+		keepSnapshots:         cfg.KeepSnapshots,
+		fork:                  cfg.Fork,
+		resume:                cfg.Resume,
 		id:                    id,
-		iterationCount: 0,
-		quit:           make(chan struct{}),
+		iterationCount:        0,
+		quit:                  make(chan struct{}),
+		prompts:               make(chan int, 16),
+		status:                StatusRunning,
 	}
+	if cfg.Fork != nil {
+		a.terminalStateOutcomes = append([]ai.CommandPair{}, cfg.Fork.Outcomes...)
+		a.progressSummary = cfg.Fork.ProgressSummary
+		a.compactedCount = cfg.Fork.CompactedCount
+		a.commandCount = cfg.Fork.Step
+		a.forkOf = cfg.Fork.Session
+		a.forkStep = cfg.Fork.Step
+	}
+	if state := cfg.Resume; state != nil {
+		a.iterationCount = state.Iteration
+		a.commandCount = state.Commands
+		a.lastCommand = state.LastCommand
+		a.lastCommandOutput = state.LastCommandOutput
+		a.lastExitCode = state.LastExitCode
+		a.terminalStateString = state.TerminalState
+		a.terminalStateOutcomes = state.Outcomes
+		a.progressSummary = state.ProgressSummary
+		a.compactedCount = state.CompactedCount
+		a.lastVerifyExitCode = state.LastVerifyExitCode
+		a.rollbackNote = state.RollbackNote
+		a.lastSnapshot = state.LastSnapshot
+		a.rollbacks = state.Rollbacks
+		a.forkOf = state.ForkOf
+		a.forkStep = state.ForkStep
+		// the budgets count from the start of the session, not of this run
+		a.resumedElapsed = state.Elapsed
+		ai.RestoreUsage(state.Usage)
+	}
+	return a
 }
 
 func (a *Actor) Loop() <-chan struct{} {
 	done := make(chan struct{})
 	logger.Logf("%s Starting actor loop.\n", a.id)
 	logger.Logf("%s Prompt: %s\n", a.id, a.goal)
-	logger.Logf("%s Model: %s\n", a.id, a.model)
+	logger.Logf("%s Provider: %s\n", a.id, a.provider.Name())
+	logger.Logf("%s Model: %s\n", a.id, a.provider.Model())
 	logger.Logf("%s Context mode: %s\n", a.id, a.contextMode)
-
-	// instantiate docker container
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.WithVersion("1.41"))
-	if err != nil {
-		panic(err)
-	}
-
-	resp, err := cli.ContainerCreate(ctx,
-		&container.Config{
-			Image: "aquarium",
-			Cmd:   []string{"tail", "-f", "/dev/null"}, // wait indefinitely
-		},
-		&container.HostConfig{
-			NetworkMode: "aquarium",
-			SecurityOpt: []string{"apparmor:unconfined"},
-		}, nil, nil, "")
-	if err != nil {
-		panic(err)
-	}
-
-	a.containerId = resp.ID
-	if err := cli.NetworkConnect(ctx, "aquarium", resp.ID, nil); err != nil {
-		panic(err)
+	if a.conversation {
+		logger.Logf("%s Conversation mode enabled\n", a.id)
 	}
-
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
+	if a.maxTokens > 0 || a.maxCost > 0 || a.maxDuration > 0 {
+		logger.Logf("%s Budget: %d tokens, $%.2f, %s (0 means unlimited)\n", a.id, a.maxTokens, a.maxCost, a.maxDuration)
 	}
 
-	logger.Logf("%s Container started with id %s\n", a.id, a.containerId)
+	a.mu.Lock()
+	a.startTime = time.Now()
+	a.mu.Unlock()
 
-	// create actor connection to terminal
-	terminalExecConfig, err := cli.ContainerExecCreate(ctx, a.containerId, types.ExecConfig{
-		Tty:          true,
-		Cmd:          []string{"/bin/bash"},
-		AttachStdin:  true,
-		AttachStderr: true,
-		AttachStdout: true,
-	})
+	var err error
+	if a.resume != nil {
+		logger.Logf("%s Resuming session after %d commands\n", a.id, a.commandCount)
+		err = a.resumeSandbox(a.resume.SandboxID)
+	} else {
+		err = a.sandbox.Start(a.ctx)
+	}
 	if err != nil {
-		panic(err)
+		a.stop(StatusFailed, fmt.Sprintf("starting sandbox: %s", err))
+		close(done)
+		return done
 	}
+	logger.Logf("%s Sandbox started with id %s\n", a.id, a.sandbox.ID())
 
-	terminalExecConnection, err := cli.ContainerExecAttach(ctx, terminalExecConfig.ID, types.ExecStartCheck{Tty: true})
-	if err != nil {
-		panic(err)
+	if a.fork != nil {
+		if err := a.sandbox.Restore(a.ctx, a.fork.Snapshot); err != nil {
+			a.stop(StatusFailed, fmt.Sprintf("restoring snapshot %s of session %s: %s", a.fork.Snapshot, a.fork.Session, err))
+			close(done)
+			return done
+		}
+		logger.Logf("%s Forked from session %s at step %d\n", a.id, a.fork.Session, a.fork.Step)
 	}
 
-	// initialize terminal
-	terminalExecConnection.Conn.Write([]byte("su ubuntu\n"))
-	terminalExecConnection.Conn.Write([]byte("cd\n"))
-	terminalExecConnection.Conn.Write([]byte("script -f /tmp/out\n")) // write all terminal output to file /tmp/out
-	terminalExecConnection.Conn.Write([]byte("/bin/bash\n"))
-	a.terminalConnection = terminalExecConnection
-	a.cli = cli
-	a.ctx = ctx
+	if err := a.attachTerminal(); err != nil {
+		a.stop(StatusFailed, fmt.Sprintf("attaching to sandbox terminal: %s", err))
+		close(done)
+		return done
+	}
+	if err := a.waitForPrompt(); err != nil {
+		a.stop(StatusFailed, fmt.Sprintf("reading sandbox terminal: %s", err))
+		close(done)
+		return done
+	}
 
-	logger.Logf("%s Container terminal attached: %s\n", a.id, a.containerId)
+	logger.Logf("%s Sandbox terminal attached: %s\n", a.id, a.sandbox.ID())
 
 	// Log all output from actor's terminal to logger.lLogTerminalf()
 	go func() {
@@ -132,7 +268,7 @@ func (a *Actor) Loop() <-chan struct{} {
 			output, err := a.ReadTerminalOut()
 			if err != nil {
 				if !strings.Contains(err.Error(), "is not running") {
-					logger.Logf("Docker terminal logging error: %s\n", err)
+					logger.Logf("Sandbox terminal logging error: %s\n", err)
 				}
 				return
 			}
@@ -143,12 +279,21 @@ func (a *Actor) Loop() <-chan struct{} {
 
 	go func() {
 		defer close(done)
+		if a.snapshotEvery > 0 {
+			logger.Logf("%s Taking a snapshot every %d commands\n", a.id, a.snapshotEvery)
+		}
+		if a.rollback {
+			logger.Logf("%s Rollback enabled\n", a.id)
+		}
 		for {
 			select {
 			case <-a.quit:
 				return
 			default:
 				a.iteration()
+				if err := a.saveState(); err != nil {
+					logger.Logf("%s Error saving session state: %s\n", a.id, err)
+				}
 				time.Sleep(1000 * time.Millisecond) // actor loop interval. meant to keep output slow and readable. can be removed
 			}
 		}
@@ -159,133 +304,135 @@ func (a *Actor) Loop() <-chan struct{} {
 
 func (a *Actor) iteration() {
 	a.iterationCount++
+	ai.SetIteration(a.iterationCount)
 	if (a.iterationLimit > 0) && (a.iterationCount > a.iterationLimit) {
-		logger.Logf("Actor %s iteration limit reached. Quitting.\n", a.id)
-		close(a.quit)
+		a.stop(StatusLimitReached, fmt.Sprintf("iteration limit of %d reached", a.iterationLimit))
 		return
 	}
 
 	handleError := func(err error) {
-		logger.Logf("Actor %s fatal error: %s\n", a.id, err)
-		close(a.quit)
+		if errors.Is(err, ai.ErrScriptFinished) {
+			a.stop(StatusCompleted, err.Error())
+			return
+		}
+		a.stop(StatusFailed, fmt.Sprintf("fatal error: %s", err))
 	}
 
-	getLastProcessPid := func() (int, error) {
-		execId, err := a.cli.ContainerExecCreate(a.ctx, a.containerId, types.ExecConfig{
-			Cmd:          []string{"cat", "/tmp/last.pid"},
-			AttachStderr: false,
-			AttachStdout: true,
-		})
-		if err != nil {
-			return 0, err
-		}
-		attachment, err := a.cli.ContainerExecAttach(a.ctx, execId.ID, types.ExecStartCheck{})
-		if err != nil {
-			return 0, err
-		}
-		defer attachment.Close()
+	var next ai.Command
+	var err error
 
-		var stdoutBuf bytes.Buffer
-		_, err = stdcopy.StdCopy(&stdoutBuf, io.Discard, attachment.Reader)
-		if err != nil {
-			return 0, err
+	if a.iterationCount == 1 && len(a.terminalStateOutcomes) == 0 {
+		if !a.withinBudget() {
+			return
 		}
-
-		pid := strings.TrimSpace(stdoutBuf.String())
-		if pid == "" {
-			// No PID file exists yet (first run)
-			return 0, nil
+		logger.Logf("%s iteration %d: asking AI for next command...\n", a.id, a.iterationCount)
+		if a.conversation {
+			next, err = ai.GenNextCommandConversation(a.provider, a.goal, "", nil)
+		} else {
+			next, err = ai.GenInitialCommand(a.provider, a.goal)
 		}
-		pidInt, err := strconv.Atoi(pid)
 		if err != nil {
-			return 0, err
+			handleError(err)
+			return
 		}
+	} else {
+		// no command ran last iteration if the AI's claim to be done was rejected
+		if a.lastCommand != "" {
+			if !a.withinBudget() {
+				return
+			}
+			logger.Logf("%s iteration %d: asking AI to summarize output of previous command... \n", a.id, a.iterationCount)
 
-		return pidInt, nil
-	}
+			var prevCommandOutcome string
+			if a.contextMode == "full" {
+				prevCommandOutcome, err = ai.GenCommandOutcome(a.provider, a.lastCommand, a.lastExitCode, a.lastCommandOutput)
+			} else {
+				lines := strings.Split(a.lastCommandOutput, "\n")
+				if len(lines) <= 100 {
+					// short output, so use the normal approach
+					prevCommandOutcome, err = ai.GenCommandOutcome(a.provider, a.lastCommand, a.lastExitCode, a.lastCommandOutput)
+				} else {
+					// long output, so summarize last X lines only
+					const CONTEXT_LINES = 100
+					lastCommandOutputTruncated := strings.Join(lines[len(lines)-CONTEXT_LINES:], "\n")
+					prevCommandOutcome, err = ai.GenCommandOutcomeTruncated(a.provider, a.lastCommand, a.lastExitCode, lastCommandOutputTruncated)
+				}
+			}
+			if err != nil {
+				handleError(err)
+				return
+			}
 
-	isLastProcessRunning := func() (bool, error) {
-		lastProcessPid, err := getLastProcessPid()
-		if err != nil {
-			return false, err
-		}
-		if lastProcessPid == 0 {
-			// No previous process to check (first run)
-			return false, nil
-		}
-		execId, err := a.cli.ContainerExecCreate(a.ctx, a.containerId, types.ExecConfig{
-			Cmd:          []string{"ls", "/proc/" + strconv.Itoa(lastProcessPid)},
-			AttachStderr: true,
-			AttachStdout: true,
-		})
-		if err != nil {
-			return false, err
+			// append to a.terminalStateOutcomes
+			a.terminalStateOutcomes = append(a.terminalStateOutcomes, ai.CommandPair{
+				Command:  a.lastCommand,
+				ExitCode: a.lastExitCode,
+				Result:   prevCommandOutcome + a.rollbackNote,
+			})
+			a.lastCommand = ""
+			a.rollbackNote = ""
 		}
-		attachment, err := a.cli.ContainerExecAttach(a.ctx, execId.ID, types.ExecStartCheck{})
-		if err != nil {
-			return false, err
-		}
-		defer attachment.Close()
 
-		var stderrBuf bytes.Buffer
-		_, err = stdcopy.StdCopy(io.Discard, &stderrBuf, attachment.Reader)
+		err = a.compactHistory()
 		if err != nil {
-			return false, err
+			handleError(err)
+			return
 		}
 
-		output := stderrBuf.String()
-		if strings.Contains(output, "cannot access") {
-			return false, nil
+		recentOutcomes := a.terminalStateOutcomes[a.compactedCount:]
+		if a.checkGoal {
+			if !a.withinBudget() {
+				return
+			}
+			logger.Logf("%s iteration %d: asking AI whether the goal is achieved...\n", a.id, a.iterationCount)
+			achieved, justification, err := ai.GenGoalCheck(a.provider, a.goal, a.progressSummary, recentOutcomes)
+			if err != nil {
+				handleError(err)
+				return
+			}
+			if achieved {
+				done, err := a.complete("", fmt.Sprintf("goal check passed: %s", justification))
+				if err != nil {
+					handleError(err)
+					return
+				}
+				if done {
+					return
+				}
+			} else {
+				logger.Logf("%s iteration %d: goal not achieved yet: %s\n", a.id, a.iterationCount, justification)
+			}
 		}
 
-		return true, nil
-	}
-
-	var nextCommand string
-	var err error
-
-	if a.iterationCount == 1 {
-		logger.Logf("%s iteration %d: asking AI for next command...\n", a.id, a.iterationCount)
-		nextCommand, err = ai.GenInitialCommand(a.model, a.url, a.goal)
-		if err != nil {
-			handleError(err)
+		if !a.withinBudget() {
 			return
 		}
-	} else {
-		logger.Logf("%s iteration %d: asking AI to summarize output of previous command... \n", a.id, a.iterationCount)
-
-		var prevCommandOutcome string
-		if a.contextMode == "full" {
-			prevCommandOutcome, err = ai.GenCommandOutcome(a.model, a.url, a.lastCommand, a.lastCommandOutput)
+		logger.Logf("%s iteration %d: asking AI for next command...\n", a.id, a.iterationCount)
+		if a.conversation {
+			next, err = ai.GenNextCommandConversation(a.provider, a.goal, a.progressSummary, recentOutcomes)
 		} else {
-			lines := strings.Split(a.lastCommandOutput, "\n")
-			if len(lines) <= 100 {
-				// short output, so use the normal approach
-				prevCommandOutcome, err = ai.GenCommandOutcome(a.model, a.url, a.lastCommand, a.lastCommandOutput)
-			} else {
-				// long output, so summarize last X lines only
-				const CONTEXT_LINES = 100
-				lastCommandOutputTruncated := strings.Join(lines[len(lines)-CONTEXT_LINES:], "\n")
-				prevCommandOutcome, err = ai.GenCommandOutcomeTruncated(a.model, a.url, a.lastCommand, lastCommandOutputTruncated)
-			}
+			next, err = ai.GenNextCommand(a.provider, a.goal, a.progressSummary, recentOutcomes)
 		}
 		if err != nil {
 			handleError(err)
 			return
 		}
+	}
 
-		// append to a.terminalStateOutcomes
-		a.terminalStateOutcomes = append(a.terminalStateOutcomes, ai.CommandPair{
-			Command: a.lastCommand,
-			Result:  prevCommandOutcome,
-		})
-
-		logger.Logf("%s iteration %d: asking AI for next command...\n", a.id, a.iterationCount)
-		nextCommand, err = ai.GenNextCommand(a.model, a.url, a.goal, a.terminalStateOutcomes)
-		if err != nil {
+	if next.TaskComplete {
+		reason := "AI declared the goal complete"
+		if next.Justification != "" {
+			reason += ": " + next.Justification
+		}
+		if _, err := a.complete(fmt.Sprintf("TASK_COMPLETE: %s", next.Justification), reason); err != nil {
 			handleError(err)
-			return
 		}
+		return
+	}
+
+	nextCommand := next.Command
+	if next.Reasoning != "" {
+		logger.Logf("%s iteration %d: reasoning: %s\n", a.id, a.iterationCount, next.Reasoning)
 	}
 
 	// rewrite apt-get as apt-get -qq
@@ -319,61 +466,83 @@ func (a *Actor) iteration() {
 		return
 	}
 
-	// Check if command starts with a shell builtin that can't be exec'd
-	shellBuiltins := []string{"cd", "export", "source", ".", "alias", "unalias", "set", "unset", "eval", "exec", "exit", "return", "break", "continue", "declare", "typeset", "local", "readonly", "shift"}
-	commandWords := strings.Fields(nextCommand)
-	isBuiltin := false
-	if len(commandWords) > 0 {
-		firstCommand := commandWords[0]
-		for _, builtin := range shellBuiltins {
-			if firstCommand == builtin {
-				isBuiltin = true
-				break
-			}
-		}
+	realCommand := shellLine(nextCommand)
+	if err := a.takeSnapshot(); err != nil {
+		handleError(err)
+		return
 	}
 
-	var realCommand string
-	if isBuiltin {
-		// For shell builtins, don't use exec since they can't be exec'd
-		realCommand = "/bin/bash -c \"echo \\$\\$>/tmp/last.pid; " + strings.ReplaceAll(nextCommand, "\"", "\"'\"'\"") + "\"\n"
-	} else {
-		realCommand = "/bin/bash -c \"echo \\$\\$>/tmp/last.pid && exec " + strings.ReplaceAll(nextCommand, "\"", "\"'\"'\"") + "\"\n"
-	}
 	// Execute command in container
+	_, err = a.containerExec("rm", "-f", exitStatusFile)
+	if err != nil {
+		handleError(err)
+		return
+	}
 	logger.Logf("%s iteration %d: executing %s\n", a.id, a.iterationCount, nextCommand)
-	a.terminalConnection.Conn.Write([]byte(realCommand))
+	// markers from earlier prompts, e.g. after a timeout, aren't for this command
+	for len(a.prompts) > 0 {
+		<-a.prompts
+	}
+	a.tty.Write([]byte(realCommand))
+	a.mu.Lock()
+	a.commandCount++
+	a.mu.Unlock()
+
+	// wait for the prompt marker that follows the command. A command that takes
+	// the shell down with it never gets a prompt, so also check /proc now and
+	// then, with optional timeout to prevent hanging on interactive commands
+	var timeout <-chan time.Time
+	if a.commandTimeoutSeconds > 0 {
+		commandTimeout := time.Duration(a.commandTimeoutSeconds) * time.Second
+		if next.ExpectsLongRunning {
+			commandTimeout *= longRunningTimeoutFactor
+		}
+		timeout = time.After(commandTimeout)
+	}
+	waitMessage := time.After(1 * time.Second)
+	processPoll := time.NewTicker(processPollInterval)
+	defer processPoll.Stop()
 
-	// wait for command to finish- poll isLastProcessRunning() until it returns false
-	// with optional timeout to prevent hanging on interactive commands
-	waitMessageSent := false
-	startTime := time.Now()
+	exitCode := ai.ExitCodeUnknown
+	promptSeen := false
+wait:
 	for {
-		isRunning, err := isLastProcessRunning()
-		time.Sleep(250 * time.Millisecond)
+		select {
+		case exitCode = <-a.prompts:
+			promptSeen = true
+			time.Sleep(promptSettleDelay)
+			break wait
+		case <-waitMessage:
+			logger.Logf("%s iteration %d: waiting for command to finish...\n", a.id, a.iterationCount)
+		case <-processPoll.C:
+			isRunning, err := a.isLastProcessRunning()
+			if err != nil {
+				handleError(err)
+				return
+			}
+			if !isRunning {
+				break wait
+			}
+		case <-timeout:
+			logger.Logf("%s iteration %d: command timeout after %v seconds, force proceeding...\n", a.id, a.iterationCount, a.commandTimeoutSeconds)
+			// Force kill the process by sending Ctrl+C to terminal
+			a.tty.Write([]byte("\x03"))        // Ctrl+C
+			time.Sleep(500 * time.Millisecond) // Give it time to process
+			break wait
+		}
+	}
+
+	if !promptSeen {
+		exitCode, err = a.readExitCode()
 		if err != nil {
 			handleError(err)
 			return
 		}
-		if !isRunning {
-			break
-		}
-		// Check for timeout (if enabled)
-		if a.commandTimeoutSeconds > 0 {
-			commandTimeout := time.Duration(a.commandTimeoutSeconds) * time.Second
-			if time.Since(startTime) > commandTimeout {
-				logger.Logf("%s iteration %d: command timeout after %v seconds, force proceeding...\n", a.id, a.iterationCount, int(commandTimeout.Seconds()))
-				// Force kill the process by sending Ctrl+C to terminal
-				a.terminalConnection.Conn.Write([]byte("\x03")) // Ctrl+C
-				time.Sleep(500 * time.Millisecond) // Give it time to process
-				break
-			}
-		}
-		if !waitMessageSent {
-			logger.Logf("%s iteration %d: waiting for command to finish...\n", a.id, a.iterationCount)
-			waitMessageSent = true
-		}
-		time.Sleep(1 * time.Second)
+	}
+	if exitCode == ai.ExitCodeUnknown {
+		logger.Logf("%s iteration %d: could not read the command's exit code\n", a.id, a.iterationCount)
+	} else {
+		logger.Logf("%s iteration %d: command exited with code %d\n", a.id, a.iterationCount, exitCode)
 	}
 
 	// read output
@@ -389,39 +558,193 @@ func (a *Actor) iteration() {
 		oldTerminalStateLineCount = 5
 	}
 	newTerminalStateLines := strings.Split(newTerminalState, "\n")
-	newTerminalStateLines = newTerminalStateLines[oldTerminalStateLineCount-1 : len(newTerminalStateLines)-2] // take difference
+	// take difference, leaving out the new prompt. Clamped in case the transcript is shorter than expected
+	from, to := oldTerminalStateLineCount-1, len(newTerminalStateLines)-2
+	if to < 0 {
+		to = 0
+	}
+	if from > to {
+		from = to
+	}
+	newTerminalStateLines = newTerminalStateLines[from:to]
 
 	// update state
 	a.lastCommandOutput = strings.Join(newTerminalStateLines, "\n")
 	a.lastCommand = nextCommand
+	a.lastExitCode = exitCode
 	a.terminalStateString = newTerminalState
+
+	verifyExitCode := -1
+	if a.verifyCommand != "" {
+		verification, err := a.verify()
+		if err != nil {
+			handleError(err)
+			return
+		}
+		if verification.Passed {
+			a.stop(StatusSucceeded, fmt.Sprintf("verification `%s` passed", a.verifyCommand))
+			return
+		}
+		verifyExitCode = verification.ExitCode
+	}
+
+	if reason := a.rollbackReason(nextCommand, exitCode, verifyExitCode); reason != "" {
+		if err := a.rollbackTo(reason); err != nil {
+			handleError(err)
+		}
+		return
+	}
+	if verifyExitCode >= 0 {
+		a.lastVerifyExitCode = verifyExitCode
+	}
 }
 
-func (a *Actor) ReadTerminalOut() (string, error) {
-	// read output
-	operatorExecConfig, err := a.cli.ContainerExecCreate(a.ctx, a.containerId, types.ExecConfig{
-		Cmd:          []string{"/bin/bash", "-c", "/tmp/logterm"},
-		AttachStdin:  true,
-		AttachStderr: true,
-		AttachStdout: true,
+// attachTerminal starts the AI's shell. Every prompt records the exit status
+// of the command before it, and prints a promptMarker so we know the command is done.
+func (a *Actor) attachTerminal() error {
+	tty, err := a.sandbox.AttachTTY(a.ctx, sandbox.TTYOptions{
+		Env: []string{`PROMPT_COMMAND=s=$?; echo $s >` + exitStatusFile + `; printf "\033]777;aquarium-done;%s\007" $s`},
 	})
 	if err != nil {
-		return "", err
+		return err
+	}
+	a.tty = tty
+	go a.watchPrompts(tty)
+	return nil
+}
+
+// waitForPrompt waits for a new terminal's first prompt, and takes the
+// transcript up to it as the start for diffing the first command's output
+func (a *Actor) waitForPrompt() error {
+	select {
+	case <-a.prompts:
+		time.Sleep(promptSettleDelay)
+	case <-time.After(firstPromptTimeout):
+		logger.Logf("%s No prompt from the sandbox terminal after %s, continuing\n", a.id, firstPromptTimeout)
 	}
-	operatorExecConnection, err := a.cli.ContainerExecAttach(a.ctx, operatorExecConfig.ID, types.ExecStartCheck{})
+	state, err := a.ReadTerminalOut()
+	if err != nil {
+		return err
+	}
+	a.terminalStateString = state
+	return nil
+}
+
+// watchPrompts reads the terminal stream and sends the exit code carried by
+// each prompt marker to a.prompts, until the terminal is closed
+func (a *Actor) watchPrompts(tty io.Reader) {
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := tty.Read(buf)
+		pending = append(pending, buf[:n]...)
+		for {
+			match := promptMarker.FindSubmatchIndex(pending)
+			if match == nil {
+				break
+			}
+			exitCode, _ := strconv.Atoi(string(pending[match[2]:match[3]]))
+			select {
+			case a.prompts <- exitCode:
+			default:
+			}
+			pending = pending[match[1]:]
+		}
+		// keep only what could be the start of a marker split across reads
+		if len(pending) > promptMarkerMaxLength {
+			pending = pending[len(pending)-promptMarkerMaxLength:]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readExitCode reads the status the shell prompt writes once the command has
+// finished. The prompt appears just after the process exits, so give it a moment.
+func (a *Actor) readExitCode() (int, error) {
+	for attempt := 0; attempt < 20; attempt++ {
+		status, err := a.containerExec("cat", exitStatusFile)
+		if err != nil {
+			return ai.ExitCodeUnknown, err
+		}
+		if exitCode, err := strconv.Atoi(strings.TrimSpace(status)); err == nil {
+			return exitCode, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// e.g. the command killed the shell, or is still running after a timeout
+	return ai.ExitCodeUnknown, nil
+}
+
+// containerExec runs a command in the sandbox and returns its stdout
+func (a *Actor) containerExec(cmd ...string) (string, error) {
+	result, err := a.sandbox.Exec(a.ctx, sandbox.ExecOptions{Cmd: cmd})
 	if err != nil {
 		return "", err
 	}
-	defer operatorExecConnection.Close()
+	return result.Stdout, nil
+}
 
-	var stdoutBuf bytes.Buffer
-	// we discard stderr here. we are using script(1) which records everything to stdout
-	_, err = stdcopy.StdCopy(&stdoutBuf, io.Discard, operatorExecConnection.Reader)
+// isLastProcessRunning checks whether the process of the last command is still alive
+func (a *Actor) isLastProcessRunning() (bool, error) {
+	pid, err := a.containerExec("cat", "/tmp/last.pid")
+	if err != nil {
+		return false, err
+	}
+	pid = strings.TrimSpace(pid)
+	if pid == "" {
+		// No previous process to check (first run)
+		return false, nil
+	}
+	if _, err := strconv.Atoi(pid); err != nil {
+		return false, err
+	}
+
+	result, err := a.sandbox.Exec(a.ctx, sandbox.ExecOptions{Cmd: []string{"test", "-d", "/proc/" + pid}})
+	if err != nil {
+		return false, err
+	}
+	return result.ExitCode == 0, nil
+}
+
+// compactHistory folds older commands into the progress summary once the
+// next-command prompt would no longer fit the model's context budget. The
+// latest keepRecentCommands commands are always sent verbatim.
+func (a *Actor) compactHistory() error {
+	recentOutcomes := a.terminalStateOutcomes[a.compactedCount:]
+	historyTokens := ai.HistoryTokens(a.provider, a.goal, a.progressSummary, recentOutcomes)
+	budget := ai.HistoryBudget(a.provider)
+	if historyTokens <= budget || len(recentOutcomes) <= keepRecentCommands {
+		return nil
+	}
+	if !a.withinBudget() {
+		return nil
+	}
+
+	compactCount := len(recentOutcomes) - keepRecentCommands
+	logger.Logf("%s iteration %d: command history is ~%d tokens, over the budget of %d. Compacting %d older commands into a progress summary...\n", a.id, a.iterationCount, historyTokens, budget, compactCount)
+
+	summary, err := ai.GenProgressSummary(a.provider, a.goal, a.progressSummary, recentOutcomes[:compactCount])
+	if err != nil {
+		return err
+	}
+	a.progressSummary = summary
+	a.compactedCount += compactCount
+
+	logger.Logf("%s iteration %d: compacted commands 1-%d into progress summary. History is now ~%d tokens.\n", a.id, a.iterationCount, a.compactedCount, ai.HistoryTokens(a.provider, a.goal, a.progressSummary, a.terminalStateOutcomes[a.compactedCount:]))
+	return nil
+}
+
+func (a *Actor) ReadTerminalOut() (string, error) {
+	a.restoreMu.RLock()
+	transcript, err := a.sandbox.ReadTranscript(a.ctx)
+	a.restoreMu.RUnlock()
 	if err != nil {
 		return "", err
 	}
 
-	raw := stdoutBuf.String()
+	raw := promptMarkerStrip.ReplaceAllString(transcript, "")
 	var sanitized string
 	raw = strings.ReplaceAll(raw, "\r", "\n")
 
@@ -448,14 +771,42 @@ func (a *Actor) ReadTerminalOut() (string, error) {
 	return deduplicated, nil
 }
 
-func (a *Actor) CleanupContainer() error {
-	logger.Logf("%s: cleaning up container %s\n", a.id, a.containerId)
+// Cleanup destroys the sandbox
+func (a *Actor) Cleanup() error {
+	logger.Logf("%s: cleaning up sandbox %s\n", a.id, a.sandbox.ID())
 	time.Sleep(250 * time.Millisecond)
-	err := a.cli.ContainerRemove(a.ctx, a.containerId, types.ContainerRemoveOptions{
-		Force: true,
-	})
-	if err != nil {
-		return err
+	if a.tty != nil {
+		a.tty.Close()
 	}
-	return nil
+	return a.sandbox.Destroy(a.ctx)
+}
+
+// shellLine is the line typed into the terminal to run command. It runs in its
+// own bash that writes its pid to /tmp/last.pid, so it can be killed on timeout.
+func shellLine(command string) string {
+	// Check if command starts with a shell builtin that can't be exec'd
+	shellBuiltins := []string{"cd", "export", "source", ".", "alias", "unalias", "set", "unset", "eval", "exec", "exit", "return", "break", "continue", "declare", "typeset", "local", "readonly", "shift"}
+	commandWords := strings.Fields(command)
+	isBuiltin := false
+	if len(commandWords) > 0 {
+		firstCommand := commandWords[0]
+		for _, builtin := range shellBuiltins {
+			if firstCommand == builtin {
+				isBuiltin = true
+				break
+			}
+		}
+	}
+
+	if strings.Contains(command, "\n") {
+		// Multi-line commands can't be exec'd, or only their first line would run.
+		// They are single-quoted so the terminal's shell leaves $, backticks and
+		// backslashes in heredocs to the bash that runs them.
+		return "/bin/bash -c " + sandbox.ShellQuote("echo $$>/tmp/last.pid; "+command) + "\n"
+	}
+	if isBuiltin {
+		// For shell builtins, don't use exec since they can't be exec'd.
+		return "/bin/bash -c \"echo \\$\\$>/tmp/last.pid; " + strings.ReplaceAll(command, "\"", "\"'\"'\"") + "\"\n"
+	}
+	return "/bin/bash -c \"echo \\$\\$>/tmp/last.pid && exec " + strings.ReplaceAll(command, "\"", "\"'\"'\"") + "\"\n"
 }
@@ -0,0 +1,163 @@
+package actor
+
+import (
+	"aquarium/ai"
+	"aquarium/logger"
+	"aquarium/sandbox"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// typedCommand pulls the AI's command out of the line the actor types
+var typedCommand = regexp.MustCompile(`exec (.*)"$`)
+
+func TestMain(m *testing.M) {
+	dir, err := logger.InitTemp()
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// runScript runs the actor against a Fake sandbox with the mock provider,
+// until the script runs out
+func runScript(t *testing.T, fake *sandbox.Fake, script string, cfg Config) *Actor {
+	path := filepath.Join(t.TempDir(), "script.yaml")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := ai.NewProvider(ai.Config{Provider: "mock", Script: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Goal = "test"
+	cfg.ContextMode = "partial"
+	cfg.IterationLimit = 10
+	cfg.CommandTimeoutSeconds = 10
+	a := NewActor(provider, fake, cfg)
+	t.Cleanup(func() { a.Cleanup() })
+	select {
+	case <-a.Loop():
+	case <-time.After(30 * time.Second):
+		t.Fatal("actor loop did not finish")
+	}
+	return a
+}
+
+func fakeShell(line string) (string, int) {
+	match := typedCommand.FindStringSubmatch(line)
+	if match == nil {
+		return "", 127
+	}
+	switch command := match[1]; {
+	case command == "ls /srv":
+		return "index.html\nstatic", 0
+	case command == "false":
+		return "", 1
+	case strings.HasPrefix(command, "rm -rf"):
+		return "rm: cannot remove '/srv': Device or resource busy", 1
+	default:
+		return "", 0
+	}
+}
+
+func TestActorRunsCommands(t *testing.T) {
+	fake := sandbox.NewFake()
+	fake.Shell = fakeShell
+	a := runScript(t, fake, "commands:\n  - ls /srv\n  - 'false'\noutcome: listed\n", Config{})
+
+	result := a.Result()
+	if result.Status != StatusCompleted {
+		t.Fatalf("status = %s (%s), want %s", result.Status, result.Reason, StatusCompleted)
+	}
+	if result.Commands != 2 {
+		t.Errorf("commands = %d, want 2", result.Commands)
+	}
+	if len(a.terminalStateOutcomes) != 2 {
+		t.Fatalf("got %d outcomes, want 2", len(a.terminalStateOutcomes))
+	}
+	ls, failed := a.terminalStateOutcomes[0], a.terminalStateOutcomes[1]
+	if ls.Command != "ls /srv" || ls.ExitCode != 0 || ls.Result != "listed" {
+		t.Errorf("first outcome = %+v, want ls /srv exiting 0 with its output summarized", ls)
+	}
+	if failed.Command != "false" || failed.ExitCode != 1 {
+		t.Errorf("second outcome = %+v, want false exiting 1", failed)
+	}
+
+	var promptCommand bool
+	for _, env := range fake.TTYEnv() {
+		promptCommand = promptCommand || strings.HasPrefix(env, "PROMPT_COMMAND=")
+	}
+	if !promptCommand {
+		t.Errorf("terminal attached without PROMPT_COMMAND: %q", fake.TTYEnv())
+	}
+}
+
+func TestActorRollsBackFailedDestructiveCommand(t *testing.T) {
+	fake := sandbox.NewFake()
+	fake.Shell = fakeShell
+	a := runScript(t, fake, "commands:\n  - touch /srv/a\n  - rm -rf /srv\noutcome: failed\n", Config{SnapshotEvery: 1, Rollback: true})
+
+	if got := len(fake.Snapshots()); got != 2 {
+		t.Errorf("took %d snapshots, want 2", got)
+	}
+	if got := fake.Restores(); len(got) != 1 || got[0] != "fake-snapshot-2" {
+		t.Errorf("restored %q, want the snapshot taken before rm", got)
+	}
+	if a.Result().Rollbacks != 1 {
+		t.Errorf("rollbacks = %d, want 1", a.Result().Rollbacks)
+	}
+	if len(a.terminalStateOutcomes) != 2 {
+		t.Fatalf("got %d outcomes, want 2", len(a.terminalStateOutcomes))
+	}
+	if rm := a.terminalStateOutcomes[1]; !strings.Contains(rm.Result, "REVERTED") {
+		t.Errorf("the AI was not told rm was reverted: %q", rm.Result)
+	}
+}
+
+func TestShellLineKeepsHeredoc(t *testing.T) {
+	dir := t.TempDir()
+	script := "for f in *; do echo \"$f\" `pwd` \\\\; done\n"
+	line := shellLine("cd " + dir + " && cat > run.sh <<'EOF'\n" + script + "EOF")
+
+	// the terminal's shell parses the line before the bash it starts does
+	if output, err := exec.Command("/bin/bash", "-c", line).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, output)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != script {
+		t.Errorf("heredoc wrote %q, want %q", written, script)
+	}
+}
+
+func TestResumeKeepsBudgetUsed(t *testing.T) {
+	t.Cleanup(func() { ai.RestoreUsage(ai.UsageReport{}) })
+	state := State{
+		ID:           "resumed",
+		Goal:         "test",
+		Status:       StatusRunning,
+		LastSnapshot: &snapshot{Ref: "fake-snapshot-1"},
+		Usage:        ai.UsageReport{Total: ai.UsageTotals{Calls: 3, PromptTokens: 900, CompletionTokens: 200}},
+		Elapsed:      time.Hour,
+	}
+	a := runScript(t, sandbox.NewFake(), "commands:\n  - ls /srv\n", Config{Resume: &state, MaxTokens: 1000})
+
+	result := a.Result()
+	if result.Status != StatusBudgetExceeded || result.Commands != 0 {
+		t.Errorf("status = %s after %d commands (%s), want %s before any command", result.Status, result.Commands, result.Reason, StatusBudgetExceeded)
+	}
+	if result.Duration < time.Hour {
+		t.Errorf("duration = %s, want it to include the hour before the resume", result.Duration)
+	}
+}
@@ -0,0 +1,127 @@
+package actor
+
+import (
+	"aquarium/ai"
+	"aquarium/logger"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Status values for Result.Status
+const (
+	StatusRunning        = "running"
+	StatusCompleted      = "completed"
+	StatusSucceeded      = "succeeded"
+	StatusLimitReached   = "limit-reached"
+	StatusBudgetExceeded = "budget-exceeded"
+	StatusFailed         = "failed"
+)
+
+// Result describes how a session ended
+type Result struct {
+	ID       string        `json:"id"`
+	Goal     string        `json:"goal"`
+	Status   string        `json:"status"`
+	Reason   string        `json:"reason"`
+	Commands int           `json:"commands"`
+	Duration time.Duration `json:"duration_ns"`
+	// ForkOf and ForkStep are the session and step this one was forked from
+	ForkOf   string `json:"fork_of,omitempty"`
+	ForkStep int    `json:"fork_step,omitempty"`
+	// Rollbacks counts how often the sandbox was restored to a snapshot
+	Rollbacks int `json:"rollbacks,omitempty"`
+	// Verification is the last run of the --verify command, if one was given
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+func (r Result) String() string {
+	result := fmt.Sprintf("Session %s ended with status '%s' after %d commands in %s: %s", r.ID, r.Status, r.Commands, r.Duration.Round(time.Second), r.Reason)
+	if r.Verification != nil {
+		result += fmt.Sprintf(" (last verification exited %d)", r.Verification.ExitCode)
+	}
+	if r.Rollbacks > 0 {
+		result += fmt.Sprintf(", with %d rollbacks", r.Rollbacks)
+	}
+	return result
+}
+
+// WriteFile saves the result as JSON
+func (r Result) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Result reports how the session is going, or how it ended once Loop is done
+func (a *Actor) Result() Result {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return Result{
+		ID:           a.id,
+		Goal:         a.goal,
+		Status:       a.status,
+		Reason:       a.stopReason,
+		Commands:     a.commandCount,
+		Duration:     a.elapsed(),
+		ForkOf:       a.forkOf,
+		ForkStep:     a.forkStep,
+		Rollbacks:    a.rollbacks,
+		Verification: a.verification,
+	}
+}
+
+// elapsed is how long the session has run, including before it was resumed.
+// It must be called with mu held.
+func (a *Actor) elapsed() time.Duration {
+	switch {
+	case a.startTime.IsZero():
+		return a.resumedElapsed
+	case a.endTime.IsZero():
+		return a.resumedElapsed + time.Since(a.startTime)
+	default:
+		return a.resumedElapsed + a.endTime.Sub(a.startTime)
+	}
+}
+
+// stop ends the actor loop with the given status. Only the first call counts.
+func (a *Actor) stop(status string, reason string) {
+	a.stopOnce.Do(func() {
+		a.mu.Lock()
+		a.status = status
+		a.stopReason = reason
+		a.endTime = time.Now()
+		a.mu.Unlock()
+
+		logger.Logf("Actor %s stopping (%s): %s\n", a.id, status, reason)
+		close(a.quit)
+	})
+}
+
+// withinBudget is checked before every AI call. If the token, cost or time
+// budget has run out the session is stopped and false is returned.
+func (a *Actor) withinBudget() bool {
+	total := ai.UsageTotal()
+	a.mu.Lock()
+	elapsed := a.elapsed()
+	a.mu.Unlock()
+
+	var reason string
+	switch {
+	case a.maxTokens > 0 && total.Tokens() >= a.maxTokens:
+		reason = fmt.Sprintf("token budget exhausted: used %d of %d tokens", total.Tokens(), a.maxTokens)
+	case a.maxCost > 0 && total.Cost >= a.maxCost:
+		reason = fmt.Sprintf("cost budget exhausted: spent an estimated $%.4f of $%.4f", total.Cost, a.maxCost)
+	case a.maxDuration > 0 && elapsed >= a.maxDuration:
+		reason = fmt.Sprintf("time budget exhausted: ran for %s of %s", elapsed.Round(time.Second), a.maxDuration)
+	default:
+		return true
+	}
+
+	a.stop(StatusBudgetExceeded, reason)
+	return false
+}
@@ -0,0 +1,224 @@
+package actor
+
+import (
+	"aquarium/ai"
+	"aquarium/logger"
+	"aquarium/sandbox"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sessionsDir holds a directory per session, named after its id
+const sessionsDir = "sessions"
+
+// stepsFilename is the JSONL file in a session directory that records a Step
+// for every snapshot
+const stepsFilename = "steps.jsonl"
+
+// stateFilename is the file in a session directory that holds its State
+const stateFilename = "state.json"
+
+// Step is the state of a session right before a command, with the snapshot
+// of the sandbox taken at that point. A session can be forked from any step.
+type Step struct {
+	// Step is how many commands the session had run
+	Step      int    `json:"step"`
+	Session   string `json:"session"`
+	Iteration int    `json:"iteration"`
+	Snapshot  string `json:"snapshot"`
+	Goal      string `json:"goal"`
+	// Outcomes is the whole command history so far, of which the first
+	// CompactedCount are folded into ProgressSummary
+	Outcomes        []ai.CommandPair `json:"outcomes"`
+	ProgressSummary string           `json:"progress_summary,omitempty"`
+	CompactedCount  int              `json:"compacted_count,omitempty"`
+	Time            time.Time        `json:"time"`
+}
+
+// NewID returns a random session id
+func NewID() string {
+	rand.Seed(time.Now().UnixNano())
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// SessionDir is where a session's steps, snapshots and logs are kept
+func SessionDir(id string) string {
+	return filepath.Join(sessionsDir, id)
+}
+
+// LoadStep reads step number k of a session, i.e. the state after its first k commands
+func LoadStep(id string, k int) (Step, error) {
+	file, err := os.Open(filepath.Join(SessionDir(id), stepsFilename))
+	if err != nil {
+		return Step{}, fmt.Errorf("could not read steps of session %s: %w", id, err)
+	}
+	defer file.Close()
+
+	var found *Step
+	var available []int
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var step Step
+		if err := json.Unmarshal(scanner.Bytes(), &step); err != nil {
+			return Step{}, fmt.Errorf("invalid steps file of session %s: %w", id, err)
+		}
+		available = append(available, step.Step)
+		if step.Step == k {
+			found = &step
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Step{}, err
+	}
+	if found == nil {
+		return Step{}, fmt.Errorf("session %s has no snapshot at step %d, only at %v", id, k, available)
+	}
+	return *found, nil
+}
+
+// recordStep appends the state before the next command to the session's steps
+func (a *Actor) recordStep(ref string) error {
+	if a.sessionDir == "" || !a.keepSnapshots {
+		return nil
+	}
+	data, err := json.Marshal(Step{
+		Step:            a.commandCount,
+		Session:         a.id,
+		Iteration:       a.iterationCount,
+		Snapshot:        ref,
+		Goal:            a.goal,
+		Outcomes:        a.terminalStateOutcomes,
+		ProgressSummary: a.progressSummary,
+		CompactedCount:  a.compactedCount,
+		Time:            time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(a.sessionDir, stepsFilename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// State is everything needed to resume a session after aquarium has stopped.
+// It is rewritten to stateFilename in the session directory after every iteration.
+type State struct {
+	ID     string `json:"id"`
+	Goal   string `json:"goal"`
+	Status string `json:"status"`
+	// SandboxID is the sandbox to reattach to, e.g. the container id
+	SandboxID          string           `json:"sandbox_id"`
+	Iteration          int              `json:"iteration"`
+	Commands           int              `json:"commands"`
+	LastCommand        string           `json:"last_command"`
+	LastCommandOutput  string           `json:"last_command_output"`
+	LastExitCode       int              `json:"last_exit_code"`
+	TerminalState      string           `json:"terminal_state"`
+	Outcomes           []ai.CommandPair `json:"outcomes"`
+	ProgressSummary    string           `json:"progress_summary,omitempty"`
+	CompactedCount     int              `json:"compacted_count,omitempty"`
+	LastVerifyExitCode int              `json:"last_verify_exit_code"`
+	RollbackNote       string           `json:"rollback_note,omitempty"`
+	LastSnapshot       *snapshot        `json:"last_snapshot,omitempty"`
+	Rollbacks          int              `json:"rollbacks,omitempty"`
+	ForkOf             string           `json:"fork_of,omitempty"`
+	ForkStep           int              `json:"fork_step,omitempty"`
+	// Usage and Elapsed are what the session has used up so far, so a resumed
+	// session keeps within its --max-tokens, --max-cost and --max-duration
+	Usage   ai.UsageReport `json:"usage"`
+	Elapsed time.Duration  `json:"elapsed_ns"`
+	Time    time.Time      `json:"time"`
+}
+
+// LoadState reads the last saved state of a session
+func LoadState(id string) (State, error) {
+	var state State
+	data, err := os.ReadFile(filepath.Join(SessionDir(id), stateFilename))
+	if err != nil {
+		return state, fmt.Errorf("could not read state of session %s: %w", id, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("invalid state of session %s: %w", id, err)
+	}
+	return state, nil
+}
+
+// saveState writes the session's state, replacing the file in one go so a
+// crash never leaves half of it behind
+func (a *Actor) saveState() error {
+	if a.sessionDir == "" {
+		return nil
+	}
+	a.mu.Lock()
+	status, rollbacks, elapsed := a.status, a.rollbacks, a.elapsed()
+	a.mu.Unlock()
+
+	data, err := json.MarshalIndent(State{
+		ID:                 a.id,
+		Goal:               a.goal,
+		Status:             status,
+		SandboxID:          a.sandbox.ID(),
+		Iteration:          a.iterationCount,
+		Commands:           a.commandCount,
+		LastCommand:        a.lastCommand,
+		LastCommandOutput:  a.lastCommandOutput,
+		LastExitCode:       a.lastExitCode,
+		TerminalState:      a.terminalStateString,
+		Outcomes:           a.terminalStateOutcomes,
+		ProgressSummary:    a.progressSummary,
+		CompactedCount:     a.compactedCount,
+		LastVerifyExitCode: a.lastVerifyExitCode,
+		RollbackNote:       a.rollbackNote,
+		LastSnapshot:       a.lastSnapshot,
+		Rollbacks:          rollbacks,
+		ForkOf:             a.forkOf,
+		ForkStep:           a.forkStep,
+		Usage:              ai.SessionUsage(),
+		Elapsed:            elapsed,
+		Time:               time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(a.sessionDir, stateFilename)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// resumeSandbox takes over the sandbox the session left behind or, if that is
+// gone, starts a new one from the last snapshot and tells the AI what was lost
+func (a *Actor) resumeSandbox(sandboxID string) error {
+	if reattacher, ok := a.sandbox.(sandbox.Reattacher); ok && sandboxID != "" {
+		err := reattacher.Reattach(a.ctx, sandboxID)
+		if err == nil {
+			logger.Logf("%s Reattached to sandbox %s\n", a.id, sandboxID)
+			return nil
+		}
+		logger.Logf("%s Could not reattach to sandbox %s: %s\n", a.id, sandboxID, err)
+	}
+	if a.lastSnapshot == nil {
+		return fmt.Errorf("sandbox %s is gone and the session has no snapshot to restore", sandboxID)
+	}
+
+	if err := a.sandbox.Start(a.ctx); err != nil {
+		return err
+	}
+	if err := a.sandbox.Restore(a.ctx, a.lastSnapshot.Ref); err != nil {
+		return fmt.Errorf("restoring snapshot %s: %w", a.lastSnapshot.Ref, err)
+	}
+	logger.Logf("%s Restored snapshot %s into a new sandbox\n", a.id, a.lastSnapshot.Ref)
+	a.noteRevert("aquarium was restarted and the server had to be restored from an earlier snapshot")
+	return nil
+}
@@ -0,0 +1,121 @@
+package actor
+
+import (
+	"aquarium/ai"
+	"aquarium/logger"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// destructiveCommand matches commands that can leave the server broken when
+// they fail halfway, such as recursive deletes and package removals
+var destructiveCommand = regexp.MustCompile(`(^|[;&|(\s])(rm\s+(-\S*[rRf]|--recursive|--force)|apt(-get)?\s+(\S+\s+)*(remove|purge|autoremove)\b|dpkg\s+(\S+\s+)*(-[rP]|--remove|--purge)\b|mkfs(\.\S+)?\s|dd\s|ch(mod|own)\s+(-\S*R|--recursive))`)
+
+// snapshot is a saved state of the sandbox the actor can roll back to
+type snapshot struct {
+	Ref string `json:"ref"`
+	// Outcomes is how many commands were in the history when it was taken
+	Outcomes int `json:"outcomes"`
+	// VerifyExitCode is the last verification exit code at the time, or -1
+	VerifyExitCode int `json:"verify_exit_code"`
+}
+
+// takeSnapshot saves the sandbox before the next command runs, every
+// snapshotEvery commands
+func (a *Actor) takeSnapshot() error {
+	if a.snapshotEvery <= 0 || a.commandCount%a.snapshotEvery != 0 {
+		return nil
+	}
+	ref, err := a.sandbox.Snapshot(a.ctx, fmt.Sprintf("%s-%d", a.id, a.commandCount))
+	if err != nil {
+		return fmt.Errorf("taking snapshot: %w", err)
+	}
+	logger.Logf("%s iteration %d: took snapshot %s\n", a.id, a.iterationCount, ref)
+	if err := a.recordStep(ref); err != nil {
+		return fmt.Errorf("recording step: %w", err)
+	}
+	a.lastSnapshot = &snapshot{
+		Ref:            ref,
+		Outcomes:       len(a.terminalStateOutcomes),
+		VerifyExitCode: a.lastVerifyExitCode,
+	}
+	return nil
+}
+
+// rollbackReason says why the command that just ran should be undone, or
+// returns "" if it shouldn't. verifyExitCode is -1 when nothing was verified.
+func (a *Actor) rollbackReason(command string, exitCode int, verifyExitCode int) string {
+	if !a.rollback || a.lastSnapshot == nil {
+		return ""
+	}
+	if exitCode != 0 && destructiveCommand.MatchString(command) {
+		if exitCode == ai.ExitCodeUnknown {
+			return "it is a destructive command that did not finish cleanly"
+		}
+		return fmt.Sprintf("it is a destructive command that failed with exit code %d", exitCode)
+	}
+	if verifyExitCode > 0 && a.lastVerifyExitCode >= 0 && verifyExitCode > a.lastVerifyExitCode {
+		return fmt.Sprintf("the check `%s` got worse after it, exiting %d instead of %d", a.verifyCommand, verifyExitCode, a.lastVerifyExitCode)
+	}
+	return ""
+}
+
+// rollbackTo restores the last snapshot and attaches a new terminal. The
+// next history entry tells the AI which commands were undone and why.
+func (a *Actor) rollbackTo(reason string) error {
+	snap := a.lastSnapshot
+	logger.Logf("%s iteration %d: rolling back to snapshot %s because %s\n", a.id, a.iterationCount, snap.Ref, reason)
+
+	a.restoreMu.Lock()
+	a.tty.Close()
+	err := a.sandbox.Restore(a.ctx, snap.Ref)
+	if err == nil {
+		err = a.attachTerminal()
+	}
+	a.restoreMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("rolling back to snapshot %s: %w", snap.Ref, err)
+	}
+
+	if err := a.waitForPrompt(); err != nil {
+		return err
+	}
+	a.noteRevert(reason)
+
+	a.mu.Lock()
+	a.rollbacks++
+	a.mu.Unlock()
+	logger.Logf("%s iteration %d: rolled back to snapshot %s\n", a.id, a.iterationCount, snap.Ref)
+	return nil
+}
+
+// noteRevert tells the AI that the sandbox went back to the last snapshot.
+// The note goes on the outcome of the last command, which is still to be
+// summarized unless the session was resumed after it had been.
+func (a *Actor) noteRevert(reason string) {
+	undone := a.terminalStateOutcomes[a.lastSnapshot.Outcomes:]
+	var last *ai.CommandPair
+	if a.lastCommand == "" {
+		if len(undone) == 0 {
+			return
+		}
+		last = &undone[len(undone)-1]
+		undone = undone[:len(undone)-1]
+	}
+
+	note := fmt.Sprintf("\nThis command was REVERTED because %s. The server was restored to how it was before it ran.", reason)
+	if len(undone) > 0 {
+		var commands []string
+		for _, outcome := range undone {
+			commands = append(commands, "`"+outcome.Command+"`")
+		}
+		note = fmt.Sprintf("\nThis command was REVERTED because %s. The server was restored to how it was before %s, so these earlier commands were undone as well: %s.", reason, commands[0], strings.Join(commands, ", "))
+	}
+	if last != nil {
+		last.Result += note
+	} else {
+		a.rollbackNote = note
+	}
+	a.lastVerifyExitCode = a.lastSnapshot.VerifyExitCode
+}
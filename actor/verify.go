@@ -0,0 +1,93 @@
+package actor
+
+import (
+	"aquarium/ai"
+	"aquarium/logger"
+	"aquarium/sandbox"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// verifyTimeoutSeconds bounds a single run of the verification command
+	verifyTimeoutSeconds = 60
+	// verifyOutputLimit is how much of the verification output is kept, from the end
+	verifyOutputLimit = 4000
+)
+
+// Verification is the result of running the user's --verify command
+type Verification struct {
+	Command   string    `json:"command"`
+	ExitCode  int       `json:"exit_code"`
+	Output    string    `json:"output"`
+	Passed    bool      `json:"passed"`
+	Iteration int       `json:"iteration"`
+	Time      time.Time `json:"time"`
+}
+
+// verify runs the verification command in its own exec, as the same user the
+// AI works as, and records the result. A zero exit code means the goal is achieved.
+func (a *Actor) verify() (Verification, error) {
+	result, err := a.sandbox.Exec(a.ctx, sandbox.ExecOptions{
+		AsAgent: true,
+		Cmd:     []string{"timeout", strconv.Itoa(verifyTimeoutSeconds), "/bin/bash", "-c", a.verifyCommand},
+	})
+	if err != nil {
+		return Verification{}, err
+	}
+
+	outputString := result.Stdout + result.Stderr
+	if len(outputString) > verifyOutputLimit {
+		outputString = outputString[len(outputString)-verifyOutputLimit:]
+	}
+	verification := Verification{
+		Command:   a.verifyCommand,
+		ExitCode:  result.ExitCode,
+		Output:    outputString,
+		Passed:    result.ExitCode == 0,
+		Iteration: a.iterationCount,
+		Time:      time.Now(),
+	}
+
+	a.mu.Lock()
+	a.verification = &verification
+	a.mu.Unlock()
+
+	if verification.Passed {
+		logger.Logf("%s iteration %d: verification passed: `%s` exited 0\n", a.id, a.iterationCount, a.verifyCommand)
+	} else {
+		logger.Logf("%s iteration %d: verification failed: `%s` exited %d\n", a.id, a.iterationCount, a.verifyCommand, verification.ExitCode)
+	}
+	return verification, nil
+}
+
+// complete ends the session as succeeded once the AI says the goal is
+// achieved, and reports whether it did. With a verification command the claim
+// only counts if it passes; otherwise a claim made as a reply (rather than by
+// the goal check) is answered in the command history and the loop goes on.
+func (a *Actor) complete(claim string, reason string) (bool, error) {
+	if a.verifyCommand == "" {
+		a.stop(StatusSucceeded, reason)
+		return true, nil
+	}
+
+	verification, err := a.verify()
+	if err != nil {
+		return false, err
+	}
+	if verification.Passed {
+		a.stop(StatusSucceeded, fmt.Sprintf("%s, and verification `%s` passed", reason, a.verifyCommand))
+		return true, nil
+	}
+
+	logger.Logf("%s iteration %d: %s, but verification failed. Continuing.\n", a.id, a.iterationCount, reason)
+	if claim != "" {
+		a.terminalStateOutcomes = append(a.terminalStateOutcomes, ai.CommandPair{
+			Command:  claim,
+			ExitCode: ai.ExitCodeUnknown,
+			Result:   fmt.Sprintf("The goal is NOT achieved yet: the check `%s` failed with exit code %d. Its output was:\n%s", a.verifyCommand, verification.ExitCode, verification.Output),
+		})
+	}
+	return false, nil
+}
@@ -0,0 +1,209 @@
+package ai
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	progressSummaryPrompt = `You are controlling an Ubuntu Linux server. %s
+
+You have been running commands towards this goal. This is a summary of your progress before the commands below:
+
+%s
+
+These are the commands you ran next, and their outcomes:
+
+%s
+Write an updated summary of your progress towards the goal. Include what has been installed or configured, important file paths, ports and versions, what failed and why, and what approaches should not be tried again. Be concise.
+
+`
+	progressSummaryNone = "(nothing has been done yet)"
+
+	defaultContextWindow = 4096
+	// responseReserve is left free in the context window for the model's reply
+	responseReserve = 1024
+)
+
+// contextWindows maps model name prefixes to context sizes in tokens.
+// More specific prefixes must come first.
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"gpt-5", 400000},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"claude", 200000},
+	{"llama3.1", 131072},
+	{"llama3.2", 131072},
+	{"llama3", 8192},
+	{"qwen2.5", 32768},
+	{"mistral", 32768},
+}
+
+// contextWindow returns the context size of a model, or the configured
+// override if one was given
+func contextWindow(cfg Config, model string) int {
+	if cfg.ContextWindow > 0 {
+		return cfg.ContextWindow
+	}
+	for _, entry := range contextWindows {
+		if strings.HasPrefix(model, entry.prefix) {
+			return entry.tokens
+		}
+	}
+	return defaultContextWindow
+}
+
+// encodings maps OpenAI model name prefixes to their tiktoken encodings. More
+// specific prefixes must come first.
+var encodings = []struct {
+	prefix   string
+	encoding string
+}{
+	{"gpt-4.1", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4.5", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4o", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4", tiktoken.MODEL_CL100K_BASE},
+	{"gpt-3.5-turbo", tiktoken.MODEL_CL100K_BASE},
+	{"gpt-5", tiktoken.MODEL_O200K_BASE},
+	{"o1", tiktoken.MODEL_O200K_BASE},
+	{"o3", tiktoken.MODEL_O200K_BASE},
+	{"o4", tiktoken.MODEL_O200K_BASE},
+}
+
+var (
+	tokenizersMu sync.Mutex
+	// tokenizers caches the loaded encodings by name
+	tokenizers = make(map[string]*tiktoken.Tiktoken)
+)
+
+func init() {
+	// the encodings are built into the binary, so counting never downloads them
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// tokenizer returns the tiktoken encoding of an OpenAI model, or nil for
+// models whose tokenizer we don't have
+func tokenizer(model string) *tiktoken.Tiktoken {
+	for _, entry := range encodings {
+		if !strings.HasPrefix(model, entry.prefix) {
+			continue
+		}
+
+		tokenizersMu.Lock()
+		defer tokenizersMu.Unlock()
+		if encoding, ok := tokenizers[entry.encoding]; ok {
+			return encoding
+		}
+		encoding, err := tiktoken.GetEncoding(entry.encoding)
+		if err != nil {
+			return nil
+		}
+		tokenizers[entry.encoding] = encoding
+		return encoding
+	}
+	return nil
+}
+
+// CountTokens counts the tokens of text for the provider's model. OpenAI models
+// are counted exactly with their tiktoken encoding; for the rest this is
+// EstimateTokens.
+func CountTokens(provider Provider, text string) int {
+	if encoding := tokenizer(provider.Model()); encoding != nil {
+		// special tokens like <|endoftext|> in command output are sent as plain text
+		return len(encoding.EncodeOrdinary(text))
+	}
+	return EstimateTokens(text)
+}
+
+// pretokenizer splits text roughly the way BPE tokenizers like cl100k do
+// before merging: contractions, words with their leading space, runs of up to
+// three digits, punctuation runs and whitespace
+var pretokenizer = regexp.MustCompile(`'(?:s|t|re|ve|m|ll|d)| ?\pL+| ?\pN{1,3}| ?[^\s\pL\pN]+|\s+`)
+
+// EstimateTokens approximates how many tokens a model will see for text, for
+// models CountTokens has no tokenizer for. It doesn't match any one tokenizer
+// exactly, so budgets built on it keep a margin.
+func EstimateTokens(text string) int {
+	count := 0
+	for _, piece := range pretokenizer.FindAllString(text, -1) {
+		// common words are a single token; long or rare ones split into ~4 character pieces
+		runes := utf8.RuneCountInString(piece)
+		if runes <= 7 {
+			count++
+		} else {
+			count += (runes + 3) / 4
+		}
+	}
+	return count
+}
+
+// HistoryBudget is the number of tokens the next-command prompt may use before
+// the history should be compacted
+func HistoryBudget(provider Provider) int {
+	return promptBudget(provider)
+}
+
+// promptBudget is the number of tokens any single prompt may use, leaving room
+// for the reply and for error in the token counts
+func promptBudget(provider Provider) int {
+	budget := provider.Capabilities().ContextWindow*3/4 - responseReserve
+	if budget < responseReserve {
+		budget = responseReserve
+	}
+	return budget
+}
+
+// HistoryTokens counts the size of the next-command prompt for this history
+func HistoryTokens(provider Provider, goal string, progressSummary string, previousCommands []CommandPair) int {
+	return CountTokens(provider, nextCommandPrompt(goal, progressSummary, previousCommands))
+}
+
+// GenProgressSummary folds previousCommands into progressSummary, producing a
+// rolling summary that replaces those commands in later prompts. Commands are
+// summarized in batches that fit the provider's context window.
+func GenProgressSummary(provider Provider, goal string, progressSummary string, previousCommands []CommandPair) (string, error) {
+	budget := promptBudget(provider)
+
+	for len(previousCommands) > 0 {
+		var batch string
+		count := 0
+		for _, pair := range previousCommands {
+			entry := fmt.Sprintf("%s\n\n", pair)
+			if count > 0 && CountTokens(provider, fmt.Sprintf(progressSummaryPrompt, goal, progressSummary, batch+entry)) > budget {
+				break
+			}
+			batch += entry
+			count++
+		}
+
+		summary := progressSummary
+		if summary == "" {
+			summary = progressSummaryNone
+		}
+		prompt := fmt.Sprintf(progressSummaryPrompt, goal, summary, batch)
+		result, err := genDialogue(provider, prompt, CallProgressSummary)
+		if err != nil {
+			return "", err
+		}
+
+		progressSummary = result
+		previousCommands = previousCommands[count:]
+	}
+
+	return progressSummary, nil
+}
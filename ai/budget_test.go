@@ -0,0 +1,28 @@
+package ai
+
+import "testing"
+
+// modelProvider is an echoProvider serving the given model
+type modelProvider struct {
+	echoProvider
+	model string
+}
+
+func (p modelProvider) Model() string { return p.model }
+
+func TestCountTokens(t *testing.T) {
+	text := "Reading package lists... Done\n<|endoftext|>"
+	for _, model := range []string{"gpt-4o-mini", "gpt-4", "o3-mini"} {
+		got := CountTokens(modelProvider{model: model}, "hello world")
+		if got != 2 {
+			t.Errorf("%s: counted %d tokens for \"hello world\", want 2", model, got)
+		}
+		if got := CountTokens(modelProvider{model: model}, text); got <= 1 {
+			t.Errorf("%s: counted %d tokens for %q, want the special token as plain text", model, got, text)
+		}
+	}
+
+	if got, want := CountTokens(modelProvider{model: "llama3.1"}, text), EstimateTokens(text); got != want {
+		t.Errorf("llama3.1: counted %d tokens, want the estimate %d", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	ReplayByOrder = "order"
+	ReplayByHash  = "hash"
+)
+
+// A cassette is a JSONL file. The first line is a cassetteHeader describing
+// the provider that was recorded, every following line is one cassetteEntry.
+type cassetteHeader struct {
+	Provider      string `json:"provider"`
+	Model         string `json:"model"`
+	Completion    bool   `json:"completion"`
+	Chat          bool   `json:"chat"`
+	Tools         bool   `json:"tools"`
+	ContextWindow int    `json:"context_window"`
+}
+
+type cassetteEntry struct {
+	// Hash identifies the request, see requestHash
+	Hash       string     `json:"hash"`
+	Prompt     string     `json:"prompt,omitempty"`
+	Messages   []Message  `json:"messages,omitempty"`
+	Text       string     `json:"text"`
+	StopReason string     `json:"stop_reason,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	Usage      Usage      `json:"usage"`
+}
+
+// requestHash is the sha256 of a request's prompt or messages. Options are
+// left out since they are the same for every call of a given kind.
+func requestHash(prompt string, messages []Message) string {
+	var data []byte
+	if messages != nil {
+		data, _ = json.Marshal(messages)
+		data = append([]byte("chat\n"), data...)
+	} else {
+		data = []byte("complete\n" + prompt)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cassetteProvider is implemented by the providers that record or replay a
+// cassette, whose requests are made one at a time so their order is fixed
+type cassetteProvider interface {
+	cassette()
+}
+
+// recordingProvider writes every request and response of the wrapped
+// provider to a cassette
+type recordingProvider struct {
+	Provider
+	mu   sync.Mutex
+	file *os.File
+}
+
+func withRecording(provider Provider, path string) (Provider, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cassette: %w", err)
+	}
+
+	capabilities := provider.Capabilities()
+	p := &recordingProvider{Provider: provider, file: file}
+	err = p.write(cassetteHeader{
+		Provider:      provider.Name(),
+		Model:         provider.Model(),
+		Completion:    capabilities.Completion,
+		Chat:          capabilities.Chat,
+		Tools:         capabilities.Tools,
+		ContextWindow: capabilities.ContextWindow,
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *recordingProvider) cassette() {}
+
+func (p *recordingProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	resp, err := p.Provider.Complete(ctx, prompt, opts)
+	if err != nil {
+		return resp, err
+	}
+	p.record(cassetteEntry{Hash: requestHash(prompt, nil), Prompt: prompt}, resp)
+	return resp, nil
+}
+
+func (p *recordingProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	resp, err := p.Provider.Chat(ctx, messages, opts)
+	if err != nil {
+		return resp, err
+	}
+	p.record(cassetteEntry{Hash: requestHash("", messages), Messages: messages}, resp)
+	return resp, nil
+}
+
+// record adds a response to the cassette. A failed write is only logged, since
+// the response was paid for and the session can go on without the recording.
+func (p *recordingProvider) record(entry cassetteEntry, resp Response) {
+	entry.Text = resp.Text
+	entry.StopReason = resp.StopReason
+	entry.ToolCalls = resp.ToolCalls
+	entry.Usage = resp.Usage
+	if err := p.write(entry); err != nil {
+		logger.Logf("%s. The cassette %s is incomplete.\n", err, p.file.Name())
+	}
+}
+
+func (p *recordingProvider) write(line interface{}) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("could not write to cassette: %w", err)
+	}
+	return nil
+}
+
+// replayProvider answers from a cassette without any network access. It
+// reports the recorded provider's name, model and capabilities, so prompts
+// are built exactly as they were during recording.
+type replayProvider struct {
+	header cassetteHeader
+	match  string
+
+	mu      sync.Mutex
+	entries []cassetteEntry
+	next    int
+	// byHash queues the responses for each request, in recorded order, so a
+	// prompt sent twice gets its two responses in turn
+	byHash map[string][]cassetteEntry
+}
+
+func newReplayProvider(path string, match string) (*replayProvider, error) {
+	if match == "" {
+		match = ReplayByHash
+	}
+	if match != ReplayByOrder && match != ReplayByHash {
+		return nil, fmt.Errorf("unknown replay match '%s'. Must be '%s' or '%s'", match, ReplayByOrder, ReplayByHash)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open cassette: %w", err)
+	}
+	defer file.Close()
+
+	p := &replayProvider{match: match, byHash: make(map[string][]cassetteEntry)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &p.header); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid cassette header: %w", path, line, err)
+			}
+			continue
+		}
+
+		var entry cassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid cassette entry: %w", path, line, err)
+		}
+		p.entries = append(p.entries, entry)
+		p.byHash[entry.Hash] = append(p.byHash[entry.Hash], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read cassette: %w", err)
+	}
+	if p.header.Provider == "" {
+		return nil, fmt.Errorf("cassette %s is empty", path)
+	}
+	return p, nil
+}
+
+func (p *replayProvider) cassette() {}
+
+func (p *replayProvider) Name() string {
+	return p.header.Provider
+}
+
+func (p *replayProvider) Model() string {
+	return p.header.Model
+}
+
+func (p *replayProvider) Capabilities() Capabilities {
+	return Capabilities{
+		Completion:    p.header.Completion,
+		Chat:          p.header.Chat,
+		Tools:         p.header.Tools,
+		ContextWindow: p.header.ContextWindow,
+	}
+}
+
+func (p *replayProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.replay(requestHash(prompt, nil))
+}
+
+func (p *replayProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	return p.replay(requestHash("", messages))
+}
+
+func (p *replayProvider) replay(hash string) (Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var entry cassetteEntry
+	if p.match == ReplayByOrder {
+		if p.next >= len(p.entries) {
+			return Response{}, fmt.Errorf("cassette exhausted after %d responses", len(p.entries))
+		}
+		entry = p.entries[p.next]
+		p.next++
+		if entry.Hash != hash {
+			// the run has diverged from the recording, which is usually the bug being chased
+			logger.Logf("Replay: request %d differs from the recorded one (hash %.12s, recorded %.12s)\n", p.next, hash, entry.Hash)
+		}
+	} else {
+		queue := p.byHash[hash]
+		if len(queue) == 0 {
+			return Response{}, fmt.Errorf("no recorded response for request with hash %.12s", hash)
+		}
+		entry = queue[0]
+		p.byHash[hash] = queue[1:]
+	}
+
+	return Response{Text: entry.Text, StopReason: entry.StopReason, ToolCalls: entry.ToolCalls, Usage: entry.Usage}, nil
+}
@@ -0,0 +1,123 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoProvider answers every request with the last message
+type echoProvider struct{}
+
+func (echoProvider) Name() string  { return "echo" }
+func (echoProvider) Model() string { return "echo-1" }
+func (echoProvider) Capabilities() Capabilities {
+	return Capabilities{Chat: true, ContextWindow: 1000}
+}
+func (echoProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return Response{Text: prompt}, nil
+}
+func (echoProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	return Response{Text: messages[len(messages)-1].Content, Usage: Usage{PromptTokens: 3, CompletionTokens: 1}}, nil
+}
+
+// slowEchoProvider is an echoProvider that answers earlier prompts, which
+// are numbered, more slowly
+type slowEchoProvider struct{ echoProvider }
+
+func (p slowEchoProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	var n int
+	fmt.Sscanf(messages[0].Content, "chunk %d", &n)
+	time.Sleep(time.Duration(10-n) * 5 * time.Millisecond)
+	return p.echoProvider.Chat(ctx, messages, opts)
+}
+
+func TestRecordingChunkSummariesKeepsOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	recorder, err := withRecording(slowEchoProvider{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prompts []string
+	for i := 0; i < 10; i++ {
+		prompts = append(prompts, fmt.Sprintf("chunk %d", i))
+	}
+	if _, err := genDialogueParallel(recorder, prompts, CallChunkSummary); err != nil {
+		t.Fatal(err)
+	}
+	recorder.(*recordingProvider).file.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for i := 0; scanner.Scan(); i++ {
+		var entry cassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Text != prompts[i] {
+			t.Errorf("request %d recorded as %q, want %q", i, entry.Text, prompts[i])
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	recorder, err := withRecording(echoProvider{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []Message{{Role: RoleUser, Content: "ls /srv"}}
+	if _, err := recorder.Chat(context.Background(), messages, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.(*recordingProvider).file.Close()
+
+	replayer, err := NewProvider(Config{Replay: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayer.Name() != "echo" || replayer.Model() != "echo-1" || replayer.Capabilities().ContextWindow != 1000 {
+		t.Errorf("replaying as %s %s %+v, want the recorded provider", replayer.Name(), replayer.Model(), replayer.Capabilities())
+	}
+	resp, err := replayer.Chat(context.Background(), messages, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "ls /srv" || resp.Usage.PromptTokens != 3 {
+		t.Errorf("replayed %+v", resp)
+	}
+	if _, err := replayer.Chat(context.Background(), []Message{{Role: RoleUser, Content: "pwd"}}, Options{}); err == nil {
+		t.Error("replayed a request that was never recorded")
+	}
+}
+
+func TestRecordingKeepsResponseWhenCassetteFails(t *testing.T) {
+	recorder, err := withRecording(echoProvider{}, filepath.Join(t.TempDir(), "run.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.(*recordingProvider).file.Close()
+
+	resp, err := recorder.Chat(context.Background(), []Message{{Role: RoleUser, Content: "ls /srv"}}, Options{})
+	if err != nil || resp.Text != "ls /srv" {
+		t.Errorf("got %+v, %v, want the response despite the failed write", resp, err)
+	}
+}
+
+func TestRecordWithReplayIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewProvider(Config{Provider: "mock", Record: filepath.Join(dir, "new.jsonl"), Replay: filepath.Join(dir, "old.jsonl")})
+	if err == nil {
+		t.Error("--record was accepted along with --replay")
+	}
+}
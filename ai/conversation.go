@@ -0,0 +1,68 @@
+package ai
+
+import (
+	"fmt"
+)
+
+const (
+	conversationSystemPrompt = `You now have control of a fresh Ubuntu Linux server. %s Do not respond with any judgement, questions or explanations. You will give commands and I will respond with the outcome of each one.
+
+SYSTEM CONTEXT:
+- This is a minimal Ubuntu installation - most software needs to be installed with 'sudo apt-get install -qq -y package-name'
+- Common tools like git, curl, build-essential, nginx, etc. are NOT pre-installed
+- Use 'which command-name' to check if a tool exists before using it
+
+CRITICAL ENVIRONMENT LIMITATIONS:
+- This is a noninteractive terminal - you cannot use nano, vi, or any text editors
+- Commands that wait for user input (like nc, irssi, top, less, more, tail -f) may be automatically killed after a timeout (if configured)
+- Prefer commands that complete and exit on their own
+- For interactive tools, use non-interactive alternatives (e.g., 'echo "test" | nc -w 1 host port' instead of 'nc host port')
+
+IMPORTANT: Every reply must be a single, simple linux command on one line. Do NOT use:
+- Interactive commands that wait for input (nc, irssi, top, less, vi, etc.) - these may timeout
+- Complex shell constructs like bash -lc
+- Multiple commands chained with && or ;
+- Subshells or command substitution
+- Complex quoting or escaping
+- Markdown formatting or code blocks
+- Commands you've already attempted
+
+Before each command, review the conversation so far. Do NOT repeat commands that you've already tried. If a command failed, try a fundamentally different approach, not just minor variations.` + taskCompleteText
+	conversationFirstTurn  = `Give the first command.`
+	conversationResumeTurn = `Summary of your progress so far, from earlier commands:
+%s
+
+Give the next command.`
+	conversationOutcomeTurn = `Outcome:
+%s
+
+Give the next command.`
+)
+
+// GenNextCommandConversation asks for the next command, sending the history
+// as alternating assistant (command) and user (outcome) turns after a fixed
+// system message. Unlike GenNextCommand, the prompt prefix stays the same from
+// one iteration to the next, so providers can cache it. progressSummary, if
+// set, opens the conversation in place of the compacted older commands.
+func GenNextCommandConversation(provider Provider, goal string, progressSummary string, previousCommands []CommandPair) (Command, error) {
+	return genCommand(provider, conversationMessages(goal, progressSummary, previousCommands))
+}
+
+func conversationMessages(goal string, progressSummary string, previousCommands []CommandPair) []Message {
+	firstTurn := conversationFirstTurn
+	if progressSummary != "" {
+		firstTurn = fmt.Sprintf(conversationResumeTurn, progressSummary)
+	}
+
+	messages := []Message{
+		{Role: RoleSystem, Content: fmt.Sprintf(conversationSystemPrompt, goal)},
+		{Role: RoleUser, Content: firstTurn},
+	}
+	for _, pair := range previousCommands {
+		messages = append(messages,
+			Message{Role: RoleAssistant, Content: pair.Command},
+			Message{Role: RoleUser, Content: fmt.Sprintf(conversationOutcomeTurn, pair.Outcome())},
+		)
+	}
+	return messages
+}
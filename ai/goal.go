@@ -0,0 +1,73 @@
+package ai
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// taskCompletePrefix starts a free-text reply that declares the goal achieved
+	taskCompletePrefix = "TASK_COMPLETE:"
+	taskCompleteText   = `
+
+If the goal has been fully achieved, respond with TASK_COMPLETE: followed by a one-sentence justification instead of a command.`
+
+	taskCompleteToolName = "task_complete"
+
+	goalCheckPrompt = `You are controlling an Ubuntu Linux server. %s
+
+These are the commands you ran, and their outcomes:
+%s
+Has the goal been fully achieved? Answer YES or NO on the first line, followed by a one-sentence justification.
+
+`
+)
+
+var taskCompleteTool = Tool{
+	Name:        taskCompleteToolName,
+	Description: "Declare that the goal has been fully achieved, ending the session.",
+	Parameters: json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"justification": {"type": "string", "description": "Why the goal is achieved, citing the commands that show it."}
+	},
+	"required": ["justification"]
+}`),
+}
+
+// parseTaskComplete validates task_complete arguments
+func parseTaskComplete(arguments json.RawMessage) (Command, error) {
+	var call struct {
+		Justification string `json:"justification"`
+	}
+	if err := json.Unmarshal(arguments, &call); err != nil {
+		return Command{}, fmt.Errorf("invalid task_complete arguments %s: %w", arguments, err)
+	}
+	return Command{TaskComplete: true, Justification: strings.TrimSpace(call.Justification)}, nil
+}
+
+// GenGoalCheck asks whether the goal has been achieved by the commands so far.
+// It returns the verdict and the model's justification.
+func GenGoalCheck(provider Provider, goal string, progressSummary string, previousCommands []CommandPair) (bool, string, error) {
+	var history string
+	if progressSummary != "" {
+		history = fmt.Sprintf(progressSection, progressSummary)
+	}
+	for _, pair := range previousCommands {
+		history += fmt.Sprintf("%s\n\n", pair)
+	}
+
+	result, err := genDialogue(provider, fmt.Sprintf(goalCheckPrompt, goal, history), CallGoalCheck)
+	if err != nil {
+		return false, "", err
+	}
+
+	firstLine, justification, _ := strings.Cut(cleanMarkdownResponse(result), "\n")
+	verdict, rest, _ := strings.Cut(strings.TrimSpace(firstLine), " ")
+	if strings.TrimSpace(justification) == "" {
+		// the justification may follow the verdict on the same line
+		justification = rest
+	}
+	return strings.HasPrefix(strings.ToUpper(verdict), "YES"), strings.TrimSpace(justification), nil
+}
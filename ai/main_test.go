@@ -0,0 +1,26 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"os"
+	"testing"
+)
+
+// ollamaWithoutLoggerEnv holds the URL of a stub ollama server in the test
+// process TestOllamaSetupWithoutLogger starts, which leaves the logger
+// uninitialized the way main does while it sets up the provider
+const ollamaWithoutLoggerEnv = "AQUARIUM_TEST_OLLAMA_WITHOUT_LOGGER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(ollamaWithoutLoggerEnv) != "" {
+		os.Exit(m.Run())
+	}
+
+	dir, err := logger.InitTemp()
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
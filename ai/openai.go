@@ -2,19 +2,11 @@ package ai
 
 import (
 	"aquarium/logger"
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"math"
-	"net/http"
-	"os"
 	"strings"
 	"sync"
-
-	"github.com/sashabaranov/go-openai"
 )
 
 const (
@@ -67,21 +59,26 @@ IMPORTANT: Give the next command as a single, simple linux command on one line.
 - Markdown formatting or code blocks
 - Commands you've already attempted
 
-Just give ONE simple command that completes and exits and that you haven't tried before.
+Just give ONE simple command that completes and exits and that you haven't tried before.` + taskCompleteText + `
+
+`
+	progressSection = `(Summary of earlier commands)
+%s
 
+(Most recent commands)
 `
 	outcomeSingle = `A Linux command was run, and this was its output:
 
 %s
 
-The original command was '%s'. What was the outcome?
+The original command was %s. What was the outcome?
 
 `
 	outcomeTruncated = `A Linux command was run, and it had a very long output. This is the last 100 lines:
 
 %s
 
-The original command was '%s'. What was the outcome?
+The original command was %s. What was the outcome?
 
 `
 	fragmentSummary = `This is the partial output of a Linux command. Please summarize what happened in this Linux command.
@@ -91,20 +88,54 @@ The original command was '%s'. What was the outcome?
 `
 	totalSummary = `A Linux command was run, and it had a very long output. The following segments are the summaries of each part of the output, in order:
 
-%sThe original command was '%s'. What was the outcome?
+%sThe original command was %s. What was the outcome?
 
 `
-	tokens              = 10000
-	recursionDepthLimit = 3
+	mergeSummaries = `These are summaries of consecutive parts of the very long output of a Linux command, in order:
+
+%sCombine them into a single summary of what happened in this part of the output.
+
+`
+	tokens = 10000
+	// parallelRequests caps how many chunk summaries are requested at once
+	parallelRequests = 4
 )
 
+// ExitCodeUnknown marks a command whose exit status couldn't be read, e.g.
+// because it killed the shell
+const ExitCodeUnknown = -1
+
 type CommandPair struct {
-	Command string
-	Result  string
+	Command  string
+	ExitCode int
+	Result   string
 }
 
 func (c CommandPair) String() string {
-	return fmt.Sprintf("%s\n%s", c.Command, c.Result)
+	return fmt.Sprintf("%s\n%s", c.Command, c.Outcome())
+}
+
+// Outcome is the result of the command, led by its exit status when known
+func (c CommandPair) Outcome() string {
+	if c.ExitCode == ExitCodeUnknown {
+		return c.Result
+	}
+	if c.ExitCode != 0 {
+		return fmt.Sprintf("Exit code: %d (FAILED)\n%s", c.ExitCode, c.Result)
+	}
+	return fmt.Sprintf("Exit code: 0 (succeeded)\n%s", c.Result)
+}
+
+// describeCommand quotes a command for the outcome prompts, with its exit status when known
+func describeCommand(command string, exitCode int) string {
+	switch exitCode {
+	case ExitCodeUnknown:
+		return fmt.Sprintf("'%s'", command)
+	case 0:
+		return fmt.Sprintf("'%s', and it exited with code 0, meaning it succeeded", command)
+	default:
+		return fmt.Sprintf("'%s', and it exited with code %d, meaning it FAILED", command, exitCode)
+	}
 }
 
 // cleanMarkdownResponse removes markdown code block formatting from AI responses
@@ -133,17 +164,16 @@ func cleanMarkdownResponse(response string) string {
 	return strings.TrimSpace(response)
 }
 
-func GenInitialCommand(model string, url string, goal string) (string, error) {
-	prompt := fmt.Sprintf(initialPrompt, goal)
-	result, err := genDialogue(model, url, prompt, true)
-	if err != nil {
-		return "", err
-	}
-
+// parseCommand extracts the command to run from an AI response
+func parseCommand(result string) (string, error) {
 	result = cleanMarkdownResponse(result)
 	if result == "" {
 		return "", errors.New("AI returned empty response")
 	}
+	if strings.HasPrefix(result, taskCompletePrefix) {
+		// kept whole so genCommand can tell it apart from a command
+		return result, nil
+	}
 	lines := strings.Split(result, "\n")
 	if len(lines) == 0 {
 		return "", errors.New("AI response contained no lines")
@@ -152,254 +182,301 @@ func GenInitialCommand(model string, url string, goal string) (string, error) {
 	return firstLine, nil
 }
 
-func GenNextCommand(model string, url string, goal string, previousCommands []CommandPair) (string, error) {
+func GenInitialCommand(provider Provider, goal string) (Command, error) {
+	prompt := fmt.Sprintf(initialPrompt, goal)
+	return genCommand(provider, []Message{{Role: RoleUser, Content: prompt}})
+}
+
+// GenNextCommand asks for the next command given the history so far.
+// progressSummary, if set, stands in for commands older than previousCommands.
+func GenNextCommand(provider Provider, goal string, progressSummary string, previousCommands []CommandPair) (Command, error) {
+	prompt := nextCommandPrompt(goal, progressSummary, previousCommands)
+	return genCommand(provider, []Message{{Role: RoleUser, Content: prompt}})
+}
+
+func nextCommandPrompt(goal string, progressSummary string, previousCommands []CommandPair) string {
 	var previousCommandsString string
+	if progressSummary != "" {
+		previousCommandsString = fmt.Sprintf(progressSection, progressSummary)
+	}
 	for _, pair := range previousCommands {
 		previousCommandsString += fmt.Sprintf("%s\n\n", pair)
 	}
 
-	prompt := fmt.Sprintf(nextPrompt, goal, previousCommandsString)
-	result, err := genDialogue(model, url, prompt, true)
-	if err != nil {
-		return "", err
-	}
+	return fmt.Sprintf(nextPrompt, goal, previousCommandsString)
+}
 
-	result = cleanMarkdownResponse(result)
-	if result == "" {
-		return "", errors.New("AI returned empty response")
-	}
-	lines := strings.Split(result, "\n")
-	if len(lines) == 0 {
-		return "", errors.New("AI response contained no lines")
-	}
-	firstLine := lines[0]
-	return firstLine, nil
+// GenCommandOutcomeTruncated is GenCommandOutcome for the last lines of a long
+// output, which can still be too large for one request
+func GenCommandOutcomeTruncated(provider Provider, previousCommand string, exitCode int, previousOutput string) (string, error) {
+	return genCommandOutcome(provider, outcomeTruncated, previousCommand, exitCode, previousOutput)
 }
 
-func GenCommandOutcomeTruncated(model string, url string, previousCommand string, previousOutput string) (string, error) {
-	prompt := fmt.Sprintf(outcomeTruncated, previousOutput, previousCommand)
-	return genDialogue(model, url, prompt, false)
+// GenCommandOutcome asks what happened when previousCommand produced
+// previousOutput. Output too large for one request is split into chunks that
+// fit the provider's budget, and the chunk summaries are reduced until they
+// fit into a single final request.
+func GenCommandOutcome(provider Provider, previousCommand string, exitCode int, previousOutput string) (string, error) {
+	return genCommandOutcome(provider, outcomeSingle, previousCommand, exitCode, previousOutput)
 }
 
-func GenCommandOutcome(model string, url string, previousCommand string, previousOutput string) (string, error) {
+// genCommandOutcome asks for the outcome with the given prompt template when
+// it fits the budget, and through chunk summaries otherwise
+func genCommandOutcome(provider Provider, template string, previousCommand string, exitCode int, previousOutput string) (string, error) {
 	if previousOutput == "" {
 		return "There was no output from this command.", nil
 	}
 
-	prompt := fmt.Sprintf(outcomeSingle, previousOutput, previousCommand)
-	response, err := genDialogue(model, url, prompt, false)
+	description := describeCommand(previousCommand, exitCode)
+	budget := promptBudget(provider)
+	prompt := fmt.Sprintf(template, previousOutput, description)
+	promptTokens := CountTokens(provider, prompt)
+	if promptTokens <= budget {
+		return genDialogue(provider, prompt, CallOutcome)
+	}
 
-	if err != nil {
-		if strings.Contains(fmt.Sprintf("%s", err), "Please reduce the length of the messages") {
-			logger.Logf("Last command output was too large to process in one request. Splitting output into chunks and summarizing chunks individually.\n")
+	chunkBudget := budget - CountTokens(provider, fmt.Sprintf(fragmentSummary, ""))
+	chunks := chunkByTokens(provider, previousOutput, chunkBudget)
+	logger.Logf("Last command output is ~%d tokens, too large for one request (budget %d). Splitting output into %d chunks and summarizing chunks individually.\n", promptTokens, budget, len(chunks))
 
-			// recursively chunk up the output and get chunk summaries
-			summaries, err := summarizeCommandOutputMultipart(model, url, previousOutput, 1)
-			if err != nil {
-				return "", err
-			}
+	var prompts []string
+	for _, chunk := range chunks {
+		prompts = append(prompts, fmt.Sprintf(fragmentSummary, chunk))
+	}
+	summaries, err := genDialogueParallel(provider, prompts, CallChunkSummary)
+	if err != nil {
+		return "", err
+	}
 
-			// then ask for the outcome of those summaries
-			response, err = determineOutcomeOfSummaryChunks(model, url, previousCommand, summaries)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return "", err
-		}
+	summaries, err = reduceSummaries(provider, description, summaries, budget)
+	if err != nil {
+		return "", err
 	}
 
-	return response, nil
+	// then ask for the outcome of those summaries
+	return determineOutcomeOfSummaryChunks(provider, description, summaries)
 }
 
-func summarizeCommandOutputMultipart(model string, url string, output string, recursionDepth int) ([]CommandPair, error) {
-	summaries := make([]CommandPair, 0)
-
-	outputLines := strings.Split(output, "\n")
-	midpoint := len(outputLines) / 2
-	firstHalf := strings.Join(outputLines[:midpoint], "\n")
-	secondHalf := strings.Join(outputLines[midpoint:], "\n")
+// reduceSummaries merges neighbouring chunk summaries, level by level, until
+// the final summary-of-summaries prompt fits within budget
+func reduceSummaries(provider Provider, command string, summaries []string, budget int) ([]string, error) {
+	for len(summaries) > 1 && CountTokens(provider, summaryOfSummariesPrompt(command, summaries)) > budget {
+		// pack consecutive summaries into groups that each fit one merge request.
+		// Every group takes at least two summaries so each level gets shorter.
+		var groups [][]string
+		for i := 0; i < len(summaries); {
+			group := []string{summaries[i]}
+			i++
+			for i < len(summaries) && (len(group) < 2 || CountTokens(provider, mergeSummariesPrompt(append(group, summaries[i]))) <= budget) {
+				group = append(group, summaries[i])
+				i++
+			}
+			groups = append(groups, group)
+		}
 
-	resultChan := make(chan []CommandPair)
-	errChan := make(chan error)
-	var wg sync.WaitGroup
+		logger.Logf("Chunk summaries are still too large for one request. Merging %d summaries into %d...\n", len(summaries), len(groups))
 
-	wg.Add(2)
+		var prompts []string
+		for _, group := range groups {
+			prompts = append(prompts, mergeSummariesPrompt(group))
+		}
+		merged, err := genDialogueParallel(provider, prompts, CallSummaryOfSummaries)
+		if err != nil {
+			return nil, err
+		}
+		summaries = merged
+	}
 
-	go summarizeCommandOutputSingle(model, url, firstHalf, recursionDepth, resultChan, errChan, &wg)
-	go summarizeCommandOutputSingle(model, url, secondHalf, recursionDepth, resultChan, errChan, &wg)
+	return summaries, nil
+}
 
-	go func() {
-		wg.Wait()
-		close(resultChan)
-		close(errChan)
-	}()
+// chunkByTokens splits text into pieces of at most budget tokens, breaking
+// between lines where possible
+func chunkByTokens(provider Provider, text string, budget int) []string {
+	if budget < 1 {
+		budget = 1
+	}
 
-	for {
-		select {
-		case result, ok := <-resultChan:
-			if ok {
-				summaries = append(summaries, result...)
-			} else {
-				resultChan = nil
+	var chunks []string
+	var chunk string
+	chunkTokens := 0
+	for _, line := range strings.Split(text, "\n") {
+		lineTokens := CountTokens(provider, line+"\n")
+		if lineTokens > budget {
+			// a single huge line (e.g. a progress bar without newlines) is cut by length
+			if chunk != "" {
+				chunks = append(chunks, chunk)
+				chunk, chunkTokens = "", 0
 			}
-		case err, ok := <-errChan:
-			if ok {
-				return nil, err
-			} else {
-				errChan = nil
+			runes := []rune(line)
+			pieceLength := len(runes) * budget / lineTokens
+			if pieceLength < 1 {
+				pieceLength = 1
 			}
+			for len(runes) > 0 {
+				n := pieceLength
+				if n > len(runes) {
+					n = len(runes)
+				}
+				chunks = append(chunks, string(runes[:n]))
+				runes = runes[n:]
+			}
+			continue
 		}
 
-		if resultChan == nil && errChan == nil {
-			break
+		if chunkTokens+lineTokens > budget {
+			chunks = append(chunks, chunk)
+			chunk, chunkTokens = "", 0
 		}
+		chunk += line + "\n"
+		chunkTokens += lineTokens
+	}
+	if chunk != "" {
+		chunks = append(chunks, chunk)
 	}
 
-	return summaries, nil
+	return chunks
 }
 
-func summarizeCommandOutputSingle(model string, url string, half string, recursionDepth int, resultChan chan<- []CommandPair, errChan chan<- error, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	logger.Logf("Summarizing chunk...\n")
-	prompt := fmt.Sprintf(fragmentSummary, half)
-	halfSummary, err := genDialogue(model, url, prompt, false)
-	if err == nil {
-		resultChan <- []CommandPair{{
-			Command: half,
-			Result:  halfSummary,
-		}}
-	} else {
-		if strings.Contains(fmt.Sprintf("%s", err), "Please reduce the length of the messages") {
-			logger.Logf("Last command output was STILL too large to process in one request. Splitting again...\n")
-			if recursionDepth+1 > recursionDepthLimit {
-				errChan <- fmt.Errorf("recursion depth limit exceeded. Output from last command was too large. (limit is %d, which implies a max of %d requests to OpenAI)", recursionDepthLimit, int(math.Pow(2, float64(recursionDepthLimit))))
-				return
-			}
-			halfPair, err := summarizeCommandOutputMultipart(model, url, half, recursionDepth+1)
-			if err != nil {
-				errChan <- err
-			} else {
-				resultChan <- halfPair
-			}
-		} else {
-			errChan <- err
+// genDialogueParallel sends each prompt as its own request, a few at a time,
+// and returns the responses in the same order as prompts
+func genDialogueParallel(provider Provider, prompts []string, callType CallType) ([]string, error) {
+	results := make([]string, len(prompts))
+	errs := make([]error, len(prompts))
+	parallel := parallelRequests
+	if _, ok := provider.(cassetteProvider); ok {
+		// cassettes are replayed in request order, which must be the same every run
+		parallel = 1
+	}
+	semaphore := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, prompt := range prompts {
+		// requests start in order, so with one at a time they are also made in order
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, prompt string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			logger.Logf("Summarizing chunk %d of %d...\n", i+1, len(prompts))
+			results[i], errs[i] = genDialogue(provider, prompt, callType)
+		}(i, prompt)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
 		}
 	}
+	return results, nil
 }
 
-func determineOutcomeOfSummaryChunks(model string, url string, command string, summaries []CommandPair) (string, error) {
-	var previousSummariesString string
-	for i, pair := range summaries {
-		previousSummariesString += fmt.Sprintf("Part %d:\n%s\n\n", i+1, pair.Result)
-	}
+func mergeSummariesPrompt(summaries []string) string {
+	return fmt.Sprintf(mergeSummaries, numberedSummaries(summaries))
+}
 
-	prompt := fmt.Sprintf(totalSummary, previousSummariesString, command)
-	return genDialogue(model, url, prompt, false)
+func summaryOfSummariesPrompt(command string, summaries []string) string {
+	return fmt.Sprintf(totalSummary, numberedSummaries(summaries), command)
 }
 
-func genDialogue(model string, url string, aiPrompt string, expectsCommand bool) (string, error) {
-	if model != "local" {
-		apiKey := os.Getenv("OPENAI_API_KEY")
-		if apiKey == "" {
-			return "", errors.New("undefined env var OPENAI_API_KEY")
-		}
+func numberedSummaries(summaries []string) string {
+	var summariesString string
+	for i, summary := range summaries {
+		summariesString += fmt.Sprintf("Part %d:\n%s\n\n", i+1, summary)
+	}
+	return summariesString
+}
 
-		ctx := context.Background()
-		client := openai.NewClient(apiKey)
+func determineOutcomeOfSummaryChunks(provider Provider, command string, summaries []string) (string, error) {
+	return genDialogue(provider, summaryOfSummariesPrompt(command, summaries), CallSummaryOfSummaries)
+}
 
-		logger.Debugf("### Sending request to OpenAI:\n%s\n\n", aiPrompt)
+func genDialogue(provider Provider, aiPrompt string, callType CallType) (string, error) {
+	return genMessages(provider, []Message{{Role: RoleUser, Content: aiPrompt}}, callType)
+}
 
-		messages := []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: aiPrompt,
-			},
-		}
-		request := openai.ChatCompletionRequest{
-			Model:               model,
-			Messages:            messages,
-			MaxCompletionTokens: tokens,
-			Temperature:         0.0,
-		}
-		resp, err := client.CreateChatCompletion(ctx, request)
+// genMessages sends a conversation to the provider and returns the reply.
+// Token usage of every request is recorded under callType.
+func genMessages(provider Provider, messages []Message, callType CallType) (string, error) {
+	resp, err := genResponse(provider, messages, callType, defaultOptions())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
 
-		if err != nil {
-			logger.Debugf("### ERROR from OpenAI:\n%s\n\n", err)
-			return "", err
-		}
+func defaultOptions() Options {
+	return Options{
+		MaxTokens:   tokens,
+		Temperature: 0.0,
+	}
+}
 
-		trimmedResponse := strings.TrimSpace(resp.Choices[0].Message.Content)
-		logger.Debugf("### Received response from OpenAI:\n%s\n\n\n", trimmedResponse)
-		return trimmedResponse, nil
+// genResponse sends messages to the provider, flattening them into a single
+// prompt for providers without chat support, and records the usage
+func genResponse(provider Provider, messages []Message, callType CallType, opts Options) (Response, error) {
+	ctx := context.WithValue(context.Background(), callTypeKey{}, callType)
+
+	var resp Response
+	var err error
+	var sentPrompt string
+	if provider.Capabilities().Chat {
+		for _, message := range messages {
+			logger.Debugf("### Sending %s message to %s:\n%s\n\n", message.Role, provider.Name(), message.Content)
+			sentPrompt += message.Content + "\n"
+		}
+		resp, err = provider.Chat(ctx, messages, opts)
 	} else {
+		aiPrompt := flattenMessages(messages)
 		var aiPromptInstruction string
-		if expectsCommand {
+		if callType == CallNextCommand && !opts.JSON {
 			aiPromptInstruction = fmt.Sprintf("\n\n### Instructions:\n%s\n### Response:\n$", aiPrompt)
 		} else {
 			aiPromptInstruction = fmt.Sprintf("\n\n### Instructions:\n%s\n### Response:\n", aiPrompt)
 		}
-
-		data := struct {
-			Prompt string   `json:"prompt"`
-			Stop   []string `json:"stop"`
-		}{
-			Prompt: aiPromptInstruction,
-			Stop:   []string{"\n", "###"},
+		opts.Stop = []string{"\n", "###"}
+		if opts.JSON {
+			// a JSON reply may be spread over several lines
+			opts.Stop = []string{"###"}
 		}
-		payloadBytes, err := json.Marshal(data)
-		if err != nil {
-			logger.Debugf("### ERROR marshalling json:\n%s\n\n", err)
-			return "", err
-		}
-		body := bytes.NewReader(payloadBytes)
-
-		req, err := http.NewRequest("POST", "http://localhost:8000/v1/completions", body)
-		if err != nil {
-			logger.Debugf("### ERROR constructing http request:\n%s\n\n", err)
-			return "", err
-		}
-		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Content-Type", "application/json")
 
-		logger.Debugf("### Sending request to local model:\n%s\n\n", aiPromptInstruction)
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			logger.Debugf("### ERROR from local model:\n%s\n\n", err)
-			return "", err
-		}
-		defer resp.Body.Close()
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logger.Debugf("### ERROR from local model:\n%s\n\n", err)
-			return "", err
-		}
+		logger.Debugf("### Sending request to %s:\n%s\n\n", provider.Name(), aiPromptInstruction)
+		sentPrompt = aiPromptInstruction
+		resp, err = provider.Complete(ctx, aiPromptInstruction, opts)
+	}
+	if err != nil {
+		logger.Debugf("### ERROR from %s:\n%s\n\n", provider.Name(), err)
+		return Response{}, err
+	}
+	recordUsage(provider, callType, resp, sentPrompt)
 
-		logger.Debugf("### Received raw response from local model:\n%s\n\n\n", respBody)
+	if strings.TrimSpace(resp.Text) == "" && len(resp.ToolCalls) == 0 {
+		return Response{}, fmt.Errorf("empty response from %s", provider.Name())
+	}
 
-		// llama-cpp-python responds in the form of:
-		// {"id":"cmpl-edfe21b1-01f4-4fb0-aef3-60b2e141404d","object":"text_completion","created":1681768157,"model":"../../13B/ggml-model-q4_0.bin","choices":[{"text":" sudo -i","index":0,"logprobs":null,"finish_reason":"stop"}],"usage":{"prompt_tokens":65,"completion_tokens":4,"total_tokens":69}
+	logger.Debugf("### Received response from %s:\n%s\n\n\n", provider.Name(), strings.TrimSpace(resp.Text))
+	for _, call := range resp.ToolCalls {
+		logger.Debugf("### Received tool call from %s:\n%s(%s)\n\n\n", provider.Name(), call.Name, call.Arguments)
+	}
+	return resp, nil
+}
 
-		var respBodyMap map[string]interface{}
-		err = json.Unmarshal(respBody, &respBodyMap)
-		if err != nil {
-			logger.Debugf("### ERROR from local model:\n%s\n\n", err)
-			return "", err
-		}
+// flattenMessages renders a conversation as a single prompt, with earlier
+// assistant replies shown as commands typed at a shell prompt
+func flattenMessages(messages []Message) string {
+	if len(messages) == 1 {
+		return messages[0].Content
+	}
 
-		// type assertion magic
-		choices := respBodyMap["choices"].([]interface{})
-		choice := choices[0].(map[string]interface{})
-		text := choice["text"].(string)
-		trimmedResponse := strings.TrimSpace(text)
-		if trimmedResponse == "" {
-			return "", errors.New("empty response from local model")
+	var prompt string
+	for _, message := range messages {
+		if message.Role == RoleAssistant {
+			prompt += fmt.Sprintf("$ %s\n\n", message.Content)
+		} else {
+			prompt += fmt.Sprintf("%s\n\n", message.Content)
 		}
-
-		logger.Debugf("### Received response from local model:\n%s\n\n\n", trimmedResponse)
-		return trimmedResponse, nil
 	}
+	return prompt
 }
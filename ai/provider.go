@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Provider is an LLM backend. Every AI call made by the Gen* functions goes
+// through a Provider, so new backends only need to implement this interface.
+type Provider interface {
+	// Name identifies the backend, e.g. "openai" or "local"
+	Name() string
+	// Model is the model name requests are sent to
+	Model() string
+	Capabilities() Capabilities
+	// Complete continues a raw text prompt
+	Complete(ctx context.Context, prompt string, opts Options) (Response, error)
+	// Chat answers a list of role-tagged messages
+	Chat(ctx context.Context, messages []Message, opts Options) (Response, error)
+}
+
+// Capabilities describes which request styles a Provider supports.
+type Capabilities struct {
+	Completion bool
+	Chat       bool
+	// Tools means Chat accepts Options.Tools and returns Response.ToolCalls
+	Tools bool
+	// ContextWindow is the model's context size in tokens
+	ContextWindow int
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Options struct {
+	MaxTokens   int
+	Temperature float32
+	Stop        []string
+	// Tools the model may call. Only sent to providers with Capabilities().Tools.
+	Tools []Tool
+	// JSON asks the backend to constrain its reply to a JSON object, where supported
+	JSON bool
+}
+
+// Tool is a function the model can call instead of replying with text
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments
+	Parameters json.RawMessage
+}
+
+// ToolCall is a model's request to call a Tool
+type ToolCall struct {
+	Name string `json:"name"`
+	// Arguments is a JSON object matching the tool's Parameters
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type Response struct {
+	Text       string
+	StopReason string
+	ToolCalls  []ToolCall
+	Usage      Usage
+}
+
+// Usage is the token count reported by the backend for a single request
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Config holds everything needed to construct any of the providers.
+type Config struct {
+	Provider string
+	Model    string // empty means the provider's default model
+	URL      string
+	// Endpoint selects the API used on a local server: "completions" or "chat"
+	Endpoint string
+	// Headers are added to every request, e.g. for auth in front of a local server
+	Headers map[string]string
+	// Timeout bounds each HTTP request. Zero means no timeout.
+	Timeout time.Duration
+	// ContextWindow overrides the model's context size in tokens, for models
+	// we don't know or servers started with a smaller context
+	ContextWindow int
+	// MaxRetries is how often a retryable error is retried. Zero disables retries.
+	MaxRetries    int
+	RetryMaxDelay time.Duration
+	// Record writes every request and response to this cassette file
+	Record string
+	// Replay answers from this cassette instead of calling Provider.
+	// ReplayMatch is "order" or "hash".
+	Replay      string
+	ReplayMatch string
+	// Script is the YAML file the mock provider answers from
+	Script string
+}
+
+func NewProvider(cfg Config) (Provider, error) {
+	if cfg.Replay != "" && cfg.Record != "" {
+		return nil, errors.New("--record and --replay can't be used together")
+	}
+	if cfg.Replay != "" {
+		return newReplayProvider(cfg.Replay, cfg.ReplayMatch)
+	}
+
+	var provider Provider
+	var err error
+	switch cfg.Provider {
+	case "openai":
+		provider, err = newOpenAIProvider(cfg)
+	case "local":
+		provider, err = newLocalProvider(cfg)
+	case "anthropic":
+		provider, err = newAnthropicProvider(cfg)
+	case "ollama":
+		provider, err = newOllamaProvider(cfg)
+	case "mock":
+		provider, err = newMockProvider(cfg)
+	default:
+		return nil, fmt.Errorf("unknown provider '%s'. Must be 'openai', 'local', 'anthropic', 'ollama' or 'mock'", cfg.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider = withRetries(provider, cfg)
+	if cfg.Record != "" {
+		return withRecording(provider, cfg.Record)
+	}
+	return provider, nil
+}
@@ -0,0 +1,231 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultAnthropicURL   = "https://api.anthropic.com"
+	defaultAnthropicModel = "claude-3-5-haiku-latest"
+	anthropicVersion      = "2023-06-01"
+	// the Messages API rejects max_tokens above the model's output limit, and
+	// older models top out at 4096. Commands and summaries are far shorter.
+	anthropicMaxTokens = 4096
+)
+
+// anthropicProvider speaks the Anthropic Messages API. The base URL can point
+// at a local HTTP stand-in via --url or ANTHROPIC_BASE_URL.
+type anthropicProvider struct {
+	apiKey        string
+	model         string
+	baseURL       string
+	headers       map[string]string
+	httpClient    *http.Client
+	contextWindow int
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+}
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	MaxTokens     int                  `json:"max_tokens"`
+	System        string               `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Temperature   float32              `json:"temperature"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+		// Name and Input are set on tool_use blocks
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newAnthropicProvider(cfg Config) (*anthropicProvider, error) {
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("undefined env var ANTHROPIC_API_KEY")
+	}
+
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = os.Getenv("ANTHROPIC_BASE_URL")
+	}
+	if baseURL == "" {
+		baseURL = defaultAnthropicURL
+	}
+
+	model := cfg.Model
+	if model == "" {
+		model = defaultAnthropicModel
+	}
+
+	return &anthropicProvider{
+		apiKey:        apiKey,
+		model:         model,
+		baseURL:       baseURL,
+		headers:       cfg.Headers,
+		httpClient:    &http.Client{Timeout: cfg.Timeout},
+		contextWindow: contextWindow(cfg, model),
+	}, nil
+}
+
+func (p *anthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *anthropicProvider) Model() string {
+	return p.model
+}
+
+func (p *anthropicProvider) Capabilities() Capabilities {
+	return Capabilities{Chat: true, Tools: true, ContextWindow: p.contextWindow}
+}
+
+// Complete sends the prompt as a single user message; the Messages API has no
+// raw completion endpoint.
+func (p *anthropicProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.Chat(ctx, []Message{{Role: RoleUser, Content: prompt}}, opts)
+}
+
+func (p *anthropicProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	request := anthropicRequest{
+		Model:         p.model,
+		MaxTokens:     opts.MaxTokens,
+		StopSequences: opts.Stop,
+		Temperature:   opts.Temperature,
+	}
+	if request.MaxTokens <= 0 || request.MaxTokens > anthropicMaxTokens {
+		request.MaxTokens = anthropicMaxTokens
+	}
+	for _, tool := range opts.Tools {
+		request.Tools = append(request.Tools, anthropicTool{Name: tool.Name, Description: tool.Description, InputSchema: tool.Parameters})
+	}
+	if len(request.Tools) > 0 {
+		// "any" makes the model call one of the tools rather than reply with text
+		request.ToolChoice = &anthropicToolChoice{Type: "any"}
+	}
+
+	// system messages are a top-level field rather than part of the conversation
+	var systemPrompts []string
+	for _, message := range messages {
+		if message.Role == RoleSystem {
+			systemPrompts = append(systemPrompts, message.Content)
+			continue
+		}
+		request.Messages = append(request.Messages, anthropicMessage{Role: message.Role, Content: message.Content})
+	}
+	request.System = strings.Join(systemPrompts, "\n\n")
+	if len(request.Messages) == 0 {
+		return Response{}, errors.New("anthropic requests need at least one user message")
+	}
+
+	payloadBytes, err := json.Marshal(request)
+	if err != nil {
+		return Response{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", resolveEndpoint(p.baseURL, "/v1/messages"), bytes.NewReader(payloadBytes))
+	if err != nil {
+		return Response{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return Response{}, newTransportError(p.Name(), err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	logger.Debugf("### Received raw response from anthropic:\n%s\n\n\n", respBody)
+
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(respBody))
+		var apiErr anthropicError
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error.Message != "" {
+			message = apiErr.Error.Type + ": " + apiErr.Error.Message
+		}
+		httpErr := newHTTPError(p.Name(), resp, message)
+		// 529 means the API is overloaded, which clears up like a 503
+		if resp.StatusCode == 529 {
+			httpErr.Retryable = true
+		}
+		return Response{}, httpErr
+	}
+
+	var messageResponse anthropicResponse
+	err = json.Unmarshal(respBody, &messageResponse)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var text string
+	var toolCalls []ToolCall
+	for _, block := range messageResponse.Content {
+		switch block.Type {
+		case "text":
+			text += block.Text
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{Name: block.Name, Arguments: block.Input})
+		}
+	}
+
+	return Response{
+		Text:       text,
+		StopReason: messageResponse.StopReason,
+		ToolCalls:  toolCalls,
+		Usage: Usage{
+			PromptTokens:     messageResponse.Usage.InputTokens,
+			CompletionTokens: messageResponse.Usage.OutputTokens,
+		},
+	}, nil
+}
@@ -0,0 +1,126 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestAnthropicProvider points an anthropic provider at handler
+func newTestAnthropicProvider(t *testing.T, handler http.HandlerFunc) *anthropicProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv("ANTHROPIC_API_KEY", "test-key")
+	p, err := newAnthropicProvider(Config{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAnthropicChat(t *testing.T) {
+	var request anthropicRequest
+	p := newTestAnthropicProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("request to %s, want /v1/messages", r.URL.Path)
+		}
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("x-api-key = %q", got)
+		}
+		if got := r.Header.Get("anthropic-version"); got != anthropicVersion {
+			t.Errorf("anthropic-version = %q", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{
+			"content": [{"type": "text", "text": "ls "}, {"type": "text", "text": "/srv"}],
+			"stop_reason": "stop_sequence",
+			"usage": {"input_tokens": 42, "output_tokens": 7}
+		}`))
+	})
+
+	resp, err := p.Chat(context.Background(), []Message{
+		{Role: RoleSystem, Content: "You are a sysadmin."},
+		{Role: RoleUser, Content: "List the web root."},
+		{Role: RoleSystem, Content: "Answer with a command."},
+	}, Options{MaxTokens: 100000, Stop: []string{"\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.System != "You are a sysadmin.\n\nAnswer with a command." {
+		t.Errorf("system = %q, want both system messages", request.System)
+	}
+	if len(request.Messages) != 1 || request.Messages[0].Role != RoleUser {
+		t.Errorf("messages = %+v, want only the user message", request.Messages)
+	}
+	if request.MaxTokens != anthropicMaxTokens {
+		t.Errorf("max_tokens = %d, want it capped at %d", request.MaxTokens, anthropicMaxTokens)
+	}
+	if resp.Text != "ls /srv" {
+		t.Errorf("text = %q, want the text blocks joined", resp.Text)
+	}
+	if resp.StopReason != "stop_sequence" {
+		t.Errorf("stop reason = %q", resp.StopReason)
+	}
+	if resp.Usage != (Usage{PromptTokens: 42, CompletionTokens: 7}) {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestAnthropicToolUse(t *testing.T) {
+	var request anthropicRequest
+	p := newTestAnthropicProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Write([]byte(`{
+			"content": [{"type": "tool_use", "name": "run_command", "input": {"command": "ls /srv"}}],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 1, "output_tokens": 1}
+		}`))
+	})
+
+	resp, err := p.Chat(context.Background(), []Message{{Role: RoleUser, Content: "next"}}, Options{Tools: []Tool{runCommandTool}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.ToolChoice == nil || request.ToolChoice.Type != "any" || len(request.Tools) != 1 {
+		t.Errorf("tools = %+v, tool_choice = %+v", request.Tools, request.ToolChoice)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Name != "run_command" || string(resp.ToolCalls[0].Arguments) != `{"command": "ls /srv"}` {
+		t.Errorf("tool calls = %+v", resp.ToolCalls)
+	}
+}
+
+func TestAnthropicErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		body      string
+		retryable bool
+		message   string
+	}{
+		{529, `{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`, true, "overloaded_error: Overloaded"},
+		{429, `{"type": "error", "error": {"type": "rate_limit_error", "message": "slow down"}}`, true, "rate_limit_error: slow down"},
+		{400, `{"type": "error", "error": {"type": "invalid_request_error", "message": "max_tokens too large"}}`, false, "invalid_request_error: max_tokens too large"},
+		{401, `not json`, false, "not json"},
+	}
+	for _, test := range tests {
+		p := newTestAnthropicProvider(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		})
+
+		_, err := p.Chat(context.Background(), []Message{{Role: RoleUser, Content: "hi"}}, Options{})
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%d: got %v, want an APIError", test.status, err)
+			continue
+		}
+		if apiErr.StatusCode != test.status || apiErr.Retryable != test.retryable || apiErr.Message != test.message {
+			t.Errorf("%d: got %+v, want retryable %t with message %q", test.status, apiErr, test.retryable, test.message)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const defaultLocalURL = "http://localhost:8000"
+
+// localProvider talks to an OpenAI-compatible server such as llama-cpp-python
+// or llama.cpp's server, using either /v1/completions or /v1/chat/completions
+type localProvider struct {
+	model         string
+	baseURL       string
+	endpoint      string
+	headers       map[string]string
+	httpClient    *http.Client
+	contextWindow int
+}
+
+func newLocalProvider(cfg Config) (*localProvider, error) {
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultLocalURL
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "completions"
+	}
+	if endpoint != "completions" && endpoint != "chat" {
+		return nil, fmt.Errorf("unknown local endpoint '%s'. Must be 'completions' or 'chat'", endpoint)
+	}
+
+	return &localProvider{
+		model:         cfg.Model,
+		baseURL:       baseURL,
+		endpoint:      endpoint,
+		headers:       cfg.Headers,
+		httpClient:    &http.Client{Timeout: cfg.Timeout},
+		contextWindow: contextWindow(cfg, cfg.Model),
+	}, nil
+}
+
+func (p *localProvider) Name() string {
+	return "local"
+}
+
+func (p *localProvider) Model() string {
+	if p.model == "" {
+		// the server decides which model to run
+		return "local"
+	}
+	return p.model
+}
+
+func (p *localProvider) Capabilities() Capabilities {
+	return Capabilities{Completion: true, Chat: p.endpoint == "chat", ContextWindow: p.contextWindow}
+}
+
+// localUsage is the OpenAI-style usage object returned by llama-cpp-python and llama.cpp
+type localUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (u localUsage) usage() Usage {
+	return Usage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens}
+}
+
+func (p *localProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	data := struct {
+		Prompt string   `json:"prompt"`
+		Stop   []string `json:"stop"`
+	}{
+		Prompt: prompt,
+		Stop:   opts.Stop,
+	}
+
+	respBody, err := p.post(ctx, "/v1/completions", data)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// llama-cpp-python responds in the form of:
+	// {"id":"cmpl-edfe21b1-01f4-4fb0-aef3-60b2e141404d","object":"text_completion","created":1681768157,"model":"../../13B/ggml-model-q4_0.bin","choices":[{"text":" sudo -i","index":0,"logprobs":null,"finish_reason":"stop"}],"usage":{"prompt_tokens":65,"completion_tokens":4,"total_tokens":69}
+
+	var completion struct {
+		Choices []struct {
+			Text         string `json:"text"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage localUsage `json:"usage"`
+	}
+	err = json.Unmarshal(respBody, &completion)
+	if err != nil {
+		return Response{}, err
+	}
+	if len(completion.Choices) == 0 {
+		return Response{}, errors.New("no choices in response from local model")
+	}
+
+	return Response{
+		Text:       completion.Choices[0].Text,
+		StopReason: completion.Choices[0].FinishReason,
+		Usage:      completion.Usage.usage(),
+	}, nil
+}
+
+func (p *localProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	type chatMessage struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+
+	var chatMessages []chatMessage
+	for _, message := range messages {
+		chatMessages = append(chatMessages, chatMessage{Role: message.Role, Content: message.Content})
+	}
+
+	type responseFormat struct {
+		Type string `json:"type"`
+	}
+
+	data := struct {
+		Model          string          `json:"model,omitempty"`
+		Messages       []chatMessage   `json:"messages"`
+		MaxTokens      int             `json:"max_tokens,omitempty"`
+		Temperature    float32         `json:"temperature"`
+		Stop           []string        `json:"stop,omitempty"`
+		ResponseFormat *responseFormat `json:"response_format,omitempty"`
+	}{
+		Model:       p.model,
+		Messages:    chatMessages,
+		MaxTokens:   opts.MaxTokens,
+		Temperature: opts.Temperature,
+		Stop:        opts.Stop,
+	}
+	if opts.JSON {
+		// llama-cpp-python and llama.cpp turn this into a JSON grammar
+		data.ResponseFormat = &responseFormat{Type: "json_object"}
+	}
+
+	respBody, err := p.post(ctx, "/v1/chat/completions", data)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var chatResponse struct {
+		Choices []struct {
+			Message      chatMessage `json:"message"`
+			FinishReason string      `json:"finish_reason"`
+		} `json:"choices"`
+		Usage localUsage `json:"usage"`
+	}
+	err = json.Unmarshal(respBody, &chatResponse)
+	if err != nil {
+		return Response{}, err
+	}
+	if len(chatResponse.Choices) == 0 {
+		return Response{}, errors.New("no choices in response from local model")
+	}
+
+	return Response{
+		Text:       chatResponse.Choices[0].Message.Content,
+		StopReason: chatResponse.Choices[0].FinishReason,
+		Usage:      chatResponse.Usage.usage(),
+	}, nil
+}
+
+// post sends a JSON payload to the given API path on the local server and
+// returns the raw response body
+func (p *localProvider) post(ctx context.Context, path string, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", resolveEndpoint(p.baseURL, path), bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, newTransportError(p.Name(), err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("### Received raw response from local model:\n%s\n\n\n", respBody)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(p.Name(), resp, strings.TrimSpace(string(respBody)))
+	}
+
+	return respBody, nil
+}
+
+// resolveEndpoint joins a server base URL and an API path like /v1/completions.
+// The base URL may or may not already include the /v1 prefix.
+func resolveEndpoint(baseURL string, path string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if strings.HasSuffix(baseURL, "/v1") {
+		path = strings.TrimPrefix(path, "/v1")
+	}
+	return baseURL + path
+}
@@ -0,0 +1,187 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultMockOutcome = "The command completed."
+
+// ErrScriptFinished is returned by the mock provider once its command sequence
+// has run out, ending the session normally
+var ErrScriptFinished = errors.New("mock script finished")
+
+// mockScript is the YAML file that drives the mock provider, e.g.
+//
+//	commands:
+//	  - sudo apt-get update
+//	  - sudo apt-get install -y nginx
+//	rules:
+//	  - match: "nginx.*failed"
+//	    call: outcome
+//	    response: "nginx failed to install."
+//	outcome: "The command ran successfully."
+type mockScript struct {
+	// Model is the name reported in logs, "mock" by default
+	Model         string `yaml:"model"`
+	ContextWindow int    `yaml:"context_window"`
+	// Commands are answered to next-command requests in turn
+	Commands []string `yaml:"commands"`
+	// Rules are tried first, in order, against the whole prompt
+	Rules []mockRule `yaml:"rules"`
+	// Outcome answers every other request that no rule matched
+	Outcome string `yaml:"outcome"`
+}
+
+type mockRule struct {
+	Match string `yaml:"match"`
+	// Call limits the rule to one kind of request, e.g. "next-command" or "outcome"
+	Call     CallType `yaml:"call"`
+	Response string   `yaml:"response"`
+
+	pattern *regexp.Regexp
+}
+
+// mockProvider answers from a script instead of a model, for demos and for
+// running the actor loop without an API key
+type mockProvider struct {
+	script        mockScript
+	contextWindow int
+
+	mu   sync.Mutex
+	next int
+}
+
+func newMockProvider(cfg Config) (*mockProvider, error) {
+	if cfg.Script == "" {
+		return nil, fmt.Errorf("the mock provider needs a --script")
+	}
+	data, err := os.ReadFile(cfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mock script: %w", err)
+	}
+
+	var script mockScript
+	if err := yaml.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("invalid mock script %s: %w", cfg.Script, err)
+	}
+	if script.Model == "" {
+		script.Model = "mock"
+	}
+	if script.Outcome == "" {
+		script.Outcome = defaultMockOutcome
+	}
+	for i := range script.Rules {
+		rule := &script.Rules[i]
+		rule.pattern, err = regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match in mock script rule %d: %w", i+1, err)
+		}
+	}
+
+	if cfg.ContextWindow == 0 {
+		cfg.ContextWindow = script.ContextWindow
+	}
+	return &mockProvider{
+		script:        script,
+		contextWindow: contextWindow(cfg, script.Model),
+	}, nil
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+func (p *mockProvider) Model() string {
+	return p.script.Model
+}
+
+func (p *mockProvider) Capabilities() Capabilities {
+	return Capabilities{Completion: true, Chat: true, Tools: true, ContextWindow: p.contextWindow}
+}
+
+func (p *mockProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.answer(ctx, prompt, opts)
+}
+
+func (p *mockProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	var prompt strings.Builder
+	for _, message := range messages {
+		prompt.WriteString(message.Content)
+		prompt.WriteString("\n")
+	}
+	return p.answer(ctx, prompt.String(), opts)
+}
+
+func (p *mockProvider) answer(ctx context.Context, prompt string, opts Options) (Response, error) {
+	callType := callTypeFrom(ctx)
+	text, err := p.scriptedText(callType, prompt)
+	if err != nil || callType != CallNextCommand {
+		return Response{Text: text}, err
+	}
+
+	// commands are scripted as plain text, so wrap them in whatever structure was asked for
+	toolName := runCommandToolName
+	var arguments []byte
+	if strings.HasPrefix(text, taskCompletePrefix) {
+		toolName = taskCompleteToolName
+		arguments, err = json.Marshal(map[string]interface{}{
+			"task_complete": true,
+			"justification": strings.TrimSpace(strings.TrimPrefix(text, taskCompletePrefix)),
+		})
+	} else {
+		arguments, err = json.Marshal(Command{Command: text, Reasoning: "scripted by " + p.script.Model})
+	}
+	if err != nil {
+		return Response{}, err
+	}
+	for _, tool := range opts.Tools {
+		if tool.Name == toolName {
+			return Response{ToolCalls: []ToolCall{{Name: toolName, Arguments: arguments}}}, nil
+		}
+	}
+	if opts.JSON {
+		return Response{Text: string(arguments)}, nil
+	}
+	return Response{Text: text}, nil
+}
+
+func (p *mockProvider) scriptedText(callType CallType, prompt string) (string, error) {
+	for _, rule := range p.script.Rules {
+		if rule.Call != "" && rule.Call != callType {
+			continue
+		}
+		if rule.pattern.MatchString(prompt) {
+			return rule.Response, nil
+		}
+	}
+
+	if callType != CallNextCommand {
+		return p.script.Outcome, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next >= len(p.script.Commands) {
+		return "", fmt.Errorf("%w after %d commands", ErrScriptFinished, len(p.script.Commands))
+	}
+	command := p.script.Commands[p.next]
+	p.next++
+	return command, nil
+}
+
+type callTypeKey struct{}
+
+// callTypeFrom returns the CallType genMessages attached to the request context
+func callTypeFrom(ctx context.Context) CallType {
+	callType, _ := ctx.Value(callTypeKey{}).(CallType)
+	return callType
+}
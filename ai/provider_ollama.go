@@ -0,0 +1,295 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const defaultOllamaURL = "http://localhost:11434"
+
+// ollamaProvider talks to Ollama's native /api/chat endpoint
+type ollamaProvider struct {
+	model         string
+	baseURL       string
+	headers       map[string]string
+	httpClient    *http.Client
+	contextWindow int
+	// tools is whether the model's template accepts tool definitions.
+	// Without it commands are asked for in JSON mode.
+	tools bool
+	// toolsErr is why tools couldn't be checked. The provider is set up
+	// before the logger, so it is logged on the first request instead.
+	toolsErr error
+	warnOnce sync.Once
+}
+
+type ollamaMessage struct {
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	ToolCalls []struct {
+		Function struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Format   string          `json:"format,omitempty"`
+	Options  struct {
+		Temperature float32  `json:"temperature"`
+		NumPredict  int      `json:"num_predict,omitempty"`
+		Stop        []string `json:"stop,omitempty"`
+	} `json:"options"`
+}
+
+type ollamaChatResponse struct {
+	Message         ollamaMessage `json:"message"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+// newOllamaProvider checks the requested model against the models Ollama has
+// pulled, so a typo fails at startup rather than on the first AI call, and
+// asks ollama whether the model can call tools
+func newOllamaProvider(cfg Config) (*ollamaProvider, error) {
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = os.Getenv("OLLAMA_HOST")
+	}
+	if baseURL == "" {
+		baseURL = defaultOllamaURL
+	}
+	if !strings.Contains(baseURL, "://") {
+		// OLLAMA_HOST is commonly given as host:port
+		baseURL = "http://" + baseURL
+	}
+
+	p := &ollamaProvider{
+		model:         cfg.Model,
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		headers:       cfg.Headers,
+		httpClient:    &http.Client{Timeout: cfg.Timeout},
+		contextWindow: contextWindow(cfg, cfg.Model),
+	}
+
+	models, err := p.listModels(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not list ollama models at %s: %w", p.baseURL, err)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("ollama at %s has no models. Pull one first, e.g. 'ollama pull llama3'", p.baseURL)
+	}
+
+	available := strings.Join(models, ", ")
+	if p.model == "" {
+		return nil, fmt.Errorf("no --model given. Models available from ollama: %s", available)
+	}
+	found := false
+	for _, name := range models {
+		// ollama tags models as name:tag, and "name" alone means "name:latest"
+		if name == p.model || name == p.model+":latest" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("model '%s' not found in ollama. Models available: %s. Pull it with 'ollama pull %s'", p.model, available, p.model)
+	}
+
+	p.tools, p.toolsErr = p.supportsTools(context.Background())
+	return p, nil
+}
+
+func (p *ollamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *ollamaProvider) Model() string {
+	return p.model
+}
+
+func (p *ollamaProvider) Capabilities() Capabilities {
+	return Capabilities{Chat: true, Tools: p.tools, ContextWindow: p.contextWindow}
+}
+
+// Complete sends the prompt as a single user message, letting ollama apply
+// the model's chat template
+func (p *ollamaProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.Chat(ctx, []Message{{Role: RoleUser, Content: prompt}}, opts)
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	if p.toolsErr != nil {
+		p.warnOnce.Do(func() {
+			logger.Logf("Could not check whether ollama model %s supports tools, using JSON mode: %s\n", p.model, p.toolsErr)
+		})
+	}
+
+	request := ollamaChatRequest{
+		Model:  p.model,
+		Stream: false,
+	}
+	request.Options.Temperature = opts.Temperature
+	request.Options.NumPredict = opts.MaxTokens
+	request.Options.Stop = opts.Stop
+	for _, tool := range opts.Tools {
+		ollamaTool := ollamaTool{Type: "function"}
+		ollamaTool.Function.Name = tool.Name
+		ollamaTool.Function.Description = tool.Description
+		ollamaTool.Function.Parameters = tool.Parameters
+		request.Tools = append(request.Tools, ollamaTool)
+	}
+	if opts.JSON {
+		request.Format = "json"
+	}
+	for _, message := range messages {
+		request.Messages = append(request.Messages, ollamaMessage{Role: message.Role, Content: message.Content})
+	}
+
+	respBody, err := p.do(ctx, "POST", "/api/chat", request)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var chatResponse ollamaChatResponse
+	err = json.Unmarshal(respBody, &chatResponse)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var toolCalls []ToolCall
+	for _, call := range chatResponse.Message.ToolCalls {
+		toolCalls = append(toolCalls, ToolCall{Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+
+	return Response{
+		Text:       chatResponse.Message.Content,
+		StopReason: chatResponse.DoneReason,
+		ToolCalls:  toolCalls,
+		Usage: Usage{
+			PromptTokens:     chatResponse.PromptEvalCount,
+			CompletionTokens: chatResponse.EvalCount,
+		},
+	}, nil
+}
+
+// listModels returns the names of all models ollama has available locally
+func (p *ollamaProvider) listModels(ctx context.Context) ([]string, error) {
+	respBody, err := p.do(ctx, "GET", "/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	err = json.Unmarshal(respBody, &tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	return names, nil
+}
+
+// supportsTools asks ollama about the model. Recent versions list its
+// capabilities; older ones only return the template, which mentions .Tools
+// when the model was trained to call them.
+func (p *ollamaProvider) supportsTools(ctx context.Context) (bool, error) {
+	respBody, err := p.do(ctx, "POST", "/api/show", map[string]string{"model": p.model})
+	if err != nil {
+		return false, err
+	}
+
+	var show struct {
+		Template     string   `json:"template"`
+		Capabilities []string `json:"capabilities"`
+	}
+	err = json.Unmarshal(respBody, &show)
+	if err != nil {
+		return false, err
+	}
+
+	if show.Capabilities == nil {
+		return strings.Contains(show.Template, ".Tools"), nil
+	}
+	for _, capability := range show.Capabilities {
+		if capability == "tools" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *ollamaProvider) do(ctx context.Context, method string, path string, payload interface{}) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payloadBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, newTransportError(p.Name(), err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("### Received raw response from ollama:\n%s\n\n\n", respBody)
+
+	if resp.StatusCode != http.StatusOK {
+		var ollamaErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &ollamaErr) == nil && ollamaErr.Error != "" {
+			return nil, newHTTPError(p.Name(), resp, ollamaErr.Error)
+		}
+		return nil, newHTTPError(p.Name(), resp, strings.TrimSpace(string(respBody)))
+	}
+
+	return respBody, nil
+}
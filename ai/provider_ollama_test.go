@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// newTestOllama serves /api/tags with the given body and status, and
+// /api/show for a model that can call tools
+func newTestOllama(t *testing.T, status int, tags string) *httptest.Server {
+	return newTestOllamaShow(t, status, tags, http.StatusOK, `{"capabilities": ["completion", "tools"]}`)
+}
+
+func newTestOllamaShow(t *testing.T, status int, tags string, showStatus int, show string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Errorf("%s /api/tags, want GET", r.Method)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(tags))
+	})
+	mux.HandleFunc("/api/show", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Model == "" {
+			t.Errorf("/api/show without a model: %v", err)
+		}
+		w.WriteHeader(showStatus)
+		w.Write([]byte(show))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+const testOllamaTags = `{"models": [{"name": "llama3:latest"}, {"name": "qwen2.5:7b"}]}`
+
+func TestOllamaFindsModel(t *testing.T) {
+	server := newTestOllama(t, http.StatusOK, testOllamaTags)
+	for _, model := range []string{"llama3", "llama3:latest", "qwen2.5:7b"} {
+		p, err := newOllamaProvider(Config{URL: server.URL + "/", Model: model})
+		if err != nil {
+			t.Errorf("%s: %v", model, err)
+			continue
+		}
+		if p.Model() != model || p.baseURL != server.URL {
+			t.Errorf("%s: got model %q at %q", model, p.Model(), p.baseURL)
+		}
+	}
+}
+
+func TestOllamaHostWithoutScheme(t *testing.T) {
+	server := newTestOllama(t, http.StatusOK, testOllamaTags)
+	t.Setenv("OLLAMA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	if _, err := newOllamaProvider(Config{Model: "llama3"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOllamaDiscoveryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		tags   string
+		model  string
+		want   string
+	}{
+		{"unknown model", http.StatusOK, testOllamaTags, "mistral", "model 'mistral' not found in ollama. Models available: llama3:latest, qwen2.5:7b"},
+		{"no model given", http.StatusOK, testOllamaTags, "", "no --model given. Models available from ollama: llama3:latest, qwen2.5:7b"},
+		{"no models pulled", http.StatusOK, `{"models": []}`, "llama3", "has no models"},
+		{"server error", http.StatusInternalServerError, `{"error": "something broke"}`, "llama3", "could not list ollama models"},
+		{"invalid response", http.StatusOK, `<html>`, "llama3", "could not list ollama models"},
+	}
+	for _, test := range tests {
+		server := newTestOllama(t, test.status, test.tags)
+		_, err := newOllamaProvider(Config{URL: server.URL, Model: test.model})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestOllamaUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err := newOllamaProvider(Config{URL: server.URL, Model: "llama3"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.Retryable || apiErr.StatusCode != 0 {
+		t.Errorf("got %v, want a retryable transport error", err)
+	}
+}
+
+func TestOllamaToolSupport(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		show   string
+		tools  bool
+	}{
+		{"tools capability", http.StatusOK, `{"capabilities": ["completion", "tools"]}`, true},
+		{"no tools capability", http.StatusOK, `{"capabilities": ["completion"]}`, false},
+		{"template with tools", http.StatusOK, `{"template": "{{- if .Tools }}{{ .Tools }}{{ end }}"}`, true},
+		{"template without tools", http.StatusOK, `{"template": "{{ .Prompt }}"}`, false},
+		{"show fails", http.StatusNotFound, `{"error": "not found"}`, false},
+	}
+	for _, test := range tests {
+		server := newTestOllamaShow(t, http.StatusOK, testOllamaTags, test.status, test.show)
+		p, err := newOllamaProvider(Config{URL: server.URL, Model: "llama3"})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if p.Capabilities().Tools != test.tools {
+			t.Errorf("%s: tools = %t, want %t", test.name, p.Capabilities().Tools, test.tools)
+		}
+	}
+}
+
+// TestOllamaSetupWithoutLogger sets up the provider while /api/show fails, in
+// a test process without a logger, as main does before logger.Init
+func TestOllamaSetupWithoutLogger(t *testing.T) {
+	if url := os.Getenv(ollamaWithoutLoggerEnv); url != "" {
+		if _, err := newOllamaProvider(Config{URL: url, Model: "llama3"}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	server := newTestOllamaShow(t, http.StatusOK, testOllamaTags, http.StatusNotFound, `{"error": "not found"}`)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestOllamaSetupWithoutLogger$")
+	cmd.Env = append(os.Environ(), ollamaWithoutLoggerEnv+"="+server.URL)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("setting up the provider without a logger failed: %s\n%s", err, output)
+	}
+}
@@ -0,0 +1,174 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const defaultOpenAIModel = "gpt-4.1-nano"
+
+type openAIProvider struct {
+	client        *openai.Client
+	model         string
+	contextWindow int
+}
+
+func newOpenAIProvider(cfg Config) (*openAIProvider, error) {
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("undefined env var OPENAI_API_KEY")
+	}
+
+	model := cfg.Model
+	if model == "" {
+		model = defaultOpenAIModel
+	}
+
+	config := openai.DefaultConfig(apiKey)
+	config.HTTPClient = retryAfterRecorder{client: &http.Client{Timeout: cfg.Timeout}}
+
+	return &openAIProvider{
+		client:        openai.NewClientWithConfig(config),
+		model:         model,
+		contextWindow: contextWindow(cfg, model),
+	}, nil
+}
+
+func (p *openAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *openAIProvider) Model() string {
+	return p.model
+}
+
+func (p *openAIProvider) Capabilities() Capabilities {
+	return Capabilities{Chat: true, Tools: true, ContextWindow: p.contextWindow}
+}
+
+// Complete sends the prompt as a single user message; OpenAI's chat models
+// have no raw completion endpoint.
+func (p *openAIProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.Chat(ctx, []Message{{Role: RoleUser, Content: prompt}}, opts)
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	var chatMessages []openai.ChatCompletionMessage
+	for _, message := range messages {
+		chatMessages = append(chatMessages, openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		})
+	}
+
+	request := openai.ChatCompletionRequest{
+		Model:               p.model,
+		Messages:            chatMessages,
+		MaxCompletionTokens: opts.MaxTokens,
+		Temperature:         opts.Temperature,
+		Stop:                opts.Stop,
+	}
+	for _, tool := range opts.Tools {
+		request.Tools = append(request.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	if len(request.Tools) > 0 {
+		// a text reply instead of a tool call is what we're trying to avoid
+		request.ToolChoice = "required"
+	}
+	if opts.JSON {
+		request.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+
+	var retryAfter time.Duration
+	resp, err := p.client.CreateChatCompletion(context.WithValue(ctx, retryAfterKey{}, &retryAfter), request)
+	if err != nil {
+		return Response{}, classifyOpenAIError(err, retryAfter)
+	}
+	if len(resp.Choices) == 0 {
+		return Response{}, errors.New("no choices in response from OpenAI")
+	}
+
+	var toolCalls []ToolCall
+	for _, call := range resp.Choices[0].Message.ToolCalls {
+		toolCalls = append(toolCalls, ToolCall{Name: call.Function.Name, Arguments: json.RawMessage(call.Function.Arguments)})
+	}
+
+	return Response{
+		Text:       resp.Choices[0].Message.Content,
+		StopReason: string(resp.Choices[0].FinishReason),
+		ToolCalls:  toolCalls,
+		Usage: Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		},
+	}, nil
+}
+
+// classifyOpenAIError turns errors from go-openai into APIErrors. A 429 caused
+// by an exhausted quota won't clear up by waiting, unlike a rate limit.
+func classifyOpenAIError(err error, retryAfter time.Duration) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		classified := &APIError{
+			Provider:   "openai",
+			StatusCode: apiErr.HTTPStatusCode,
+			Message:    apiErr.Message,
+			RetryAfter: retryAfter,
+			Retryable:  retryableStatus(apiErr.HTTPStatusCode),
+		}
+		if apiErr.Type == "insufficient_quota" || apiErr.Code == "insufficient_quota" {
+			classified.Retryable = false
+		}
+		return classified
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) && reqErr.HTTPStatusCode != 0 {
+		return &APIError{
+			Provider:   "openai",
+			StatusCode: reqErr.HTTPStatusCode,
+			Message:    reqErr.Error(),
+			RetryAfter: retryAfter,
+			Retryable:  retryableStatus(reqErr.HTTPStatusCode),
+		}
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return newTransportError("openai", err)
+	}
+
+	return err
+}
+
+type retryAfterKey struct{}
+
+// retryAfterRecorder passes the Retry-After header of a response back to the
+// caller through the request context, since go-openai's errors drop headers
+type retryAfterRecorder struct {
+	client *http.Client
+}
+
+func (r retryAfterRecorder) Do(req *http.Request) (*http.Response, error) {
+	resp, err := r.client.Do(req)
+	if err == nil {
+		if retryAfter, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+			*retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,163 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryMaxDelay = 60 * time.Second
+	retryBaseDelay       = 1 * time.Second
+)
+
+// APIError is a failed request to a provider. Each provider decides whether
+// its errors are worth retrying.
+type APIError struct {
+	Provider string
+	// StatusCode is the HTTP status, or 0 if no response was received
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked us to wait, if it said
+	RetryAfter time.Duration
+	Retryable  bool
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s request failed: %s", e.Provider, e.Message)
+	}
+	return fmt.Sprintf("%s returned %d %s: %s", e.Provider, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// newHTTPError classifies an HTTP error response by status code. Rate limits,
+// timeouts and server errors are retryable; anything else means the request
+// itself is bad and will fail again.
+func newHTTPError(provider string, resp *http.Response, message string) *APIError {
+	return &APIError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Retryable:  retryableStatus(resp.StatusCode),
+	}
+}
+
+// newTransportError wraps an error from sending the request, e.g. connection
+// refused while a local server is still starting, or a request timeout
+func newTransportError(provider string, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &APIError{
+		Provider:  provider,
+		Message:   err.Error(),
+		Retryable: true,
+	}
+}
+
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// retryingProvider retries retryable errors from the wrapped provider with
+// exponential backoff and jitter
+type retryingProvider struct {
+	Provider
+	maxRetries int
+	maxDelay   time.Duration
+}
+
+func withRetries(provider Provider, cfg Config) Provider {
+	if cfg.MaxRetries <= 0 {
+		return provider
+	}
+
+	maxDelay := cfg.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	return &retryingProvider{
+		Provider:   provider,
+		maxRetries: cfg.MaxRetries,
+		maxDelay:   maxDelay,
+	}
+}
+
+func (p *retryingProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.retry(ctx, func() (Response, error) {
+		return p.Provider.Complete(ctx, prompt, opts)
+	})
+}
+
+func (p *retryingProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	return p.retry(ctx, func() (Response, error) {
+		return p.Provider.Chat(ctx, messages, opts)
+	})
+}
+
+func (p *retryingProvider) retry(ctx context.Context, request func() (Response, error)) (Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := request()
+		if err == nil {
+			return resp, nil
+		}
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.Retryable || attempt > p.maxRetries {
+			return Response{}, err
+		}
+
+		delay := p.backoff(attempt, apiErr.RetryAfter)
+		logger.Logf("%s. Retrying in %.1fs (retry %d of %d)...\n", err, delay.Seconds(), attempt, p.maxRetries)
+
+		select {
+		case <-ctx.Done():
+			return Response{}, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff doubles the delay on every attempt, up to maxDelay, and picks a
+// random point in the upper half so parallel requests don't retry in lockstep.
+// A Retry-After from the server always wins.
+func (p *retryingProvider) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	delay := p.maxDelay
+	if attempt < 32 && retryBaseDelay<<(attempt-1) < p.maxDelay {
+		delay = retryBaseDelay << (attempt - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
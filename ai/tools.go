@@ -0,0 +1,179 @@
+package ai
+
+import (
+	"aquarium/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	runCommandToolName = "run_command"
+
+	toolCallInstruction = `
+
+Call the run_command tool with the command to run. This replaces the one-line rule above: the command may span multiple lines when needed, for example to write a file with a heredoc. If the goal has been fully achieved, call the task_complete tool instead.`
+	jsonInstruction = `
+
+Respond with only a JSON object, with no other text, in this form:
+{"command": "the command to run", "reasoning": "why this command moves towards the goal", "expects_long_running": false}
+Set expects_long_running to true for commands that take minutes, such as large downloads or builds. This replaces the one-line rule above: the command may span multiple lines when needed, for example to write a file with a heredoc.
+If the goal has been fully achieved, respond with this instead:
+{"task_complete": true, "justification": "why the goal is achieved"}`
+	invalidReplyPrompt = `Your reply could not be used: %s
+Reply again, following the instructions above exactly.`
+
+	// invalidReplyRetries is how often an invalid reply is sent back to the
+	// model with the error before the run stops
+	invalidReplyRetries = 2
+)
+
+var runCommandTool = Tool{
+	Name:        runCommandToolName,
+	Description: "Run a shell command in the terminal of the Ubuntu server.",
+	Parameters: json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"command": {"type": "string", "description": "The command to run. May span multiple lines, e.g. for a heredoc."},
+		"reasoning": {"type": "string", "description": "Why this command moves towards the goal."},
+		"expects_long_running": {"type": "boolean", "description": "True if the command is expected to take minutes, such as a large download or build."}
+	},
+	"required": ["command", "reasoning"]
+}`),
+}
+
+// Command is the next command the AI wants to run
+type Command struct {
+	Command   string `json:"command"`
+	Reasoning string `json:"reasoning"`
+	// ExpectsLongRunning asks for more time before the command is timed out
+	ExpectsLongRunning bool `json:"expects_long_running"`
+
+	// TaskComplete means the AI declared the goal achieved instead of giving a command
+	TaskComplete  bool   `json:"-"`
+	Justification string `json:"-"`
+}
+
+var toolCalling bool
+
+// SetToolCalling switches next-command requests from free text to run_command
+// calls. Providers without tool support are asked for a JSON object instead.
+func SetToolCalling(enabled bool) {
+	toolCalling = enabled
+}
+
+// genCommand asks for the next command, as free text or as a run_command call
+func genCommand(provider Provider, messages []Message) (Command, error) {
+	if !toolCalling {
+		result, err := genMessages(provider, messages, CallNextCommand)
+		if err != nil {
+			return Command{}, err
+		}
+		command, err := parseCommand(result)
+		if err != nil {
+			return Command{}, err
+		}
+		if strings.HasPrefix(command, taskCompletePrefix) {
+			justification := strings.TrimPrefix(command, taskCompletePrefix)
+			return Command{TaskComplete: true, Justification: strings.TrimSpace(justification)}, nil
+		}
+		return Command{Command: command}, nil
+	}
+
+	opts := defaultOptions()
+	instruction := jsonInstruction
+	if provider.Capabilities().Tools {
+		opts.Tools = []Tool{runCommandTool, taskCompleteTool}
+		instruction = toolCallInstruction
+	} else {
+		opts.JSON = true
+	}
+
+	// the instruction goes last, where it can't be missed
+	messages = append([]Message{}, messages...)
+	last := &messages[len(messages)-1]
+	last.Content += instruction
+
+	for attempt := 0; ; attempt++ {
+		resp, err := genResponse(provider, messages, CallNextCommand, opts)
+		if err != nil {
+			return Command{}, err
+		}
+		command, err := parseCommandResponse(resp)
+		if err == nil || attempt == invalidReplyRetries {
+			return command, err
+		}
+
+		// models in JSON mode often get a field wrong, and usually fix it when told
+		logger.Logf("AI reply was invalid, asking again: %s\n", err)
+		messages = append(messages,
+			Message{Role: RoleAssistant, Content: replyContent(resp)},
+			Message{Role: RoleUser, Content: fmt.Sprintf(invalidReplyPrompt, err)})
+	}
+}
+
+// parseCommandResponse reads the command from a run_command or task_complete
+// call, or from a JSON object in the reply text
+func parseCommandResponse(resp Response) (Command, error) {
+	for _, call := range resp.ToolCalls {
+		switch call.Name {
+		case runCommandToolName:
+			return parseCommandArguments(call.Arguments)
+		case taskCompleteToolName:
+			return parseTaskComplete(call.Arguments)
+		}
+	}
+	if len(resp.ToolCalls) > 0 {
+		return Command{}, fmt.Errorf("AI called unknown tool '%s'", resp.ToolCalls[0].Name)
+	}
+	// some models answer with the JSON as text even when offered a tool
+	return parseCommandJSON(resp.Text)
+}
+
+// replyContent is an invalid reply as it is shown to the model when it is
+// asked again
+func replyContent(resp Response) string {
+	content := resp.Text
+	for _, call := range resp.ToolCalls {
+		content += fmt.Sprintf("\n%s %s", call.Name, call.Arguments)
+	}
+	return strings.TrimSpace(content)
+}
+
+// parseCommandJSON extracts a run_command object from a text reply, allowing
+// for markdown fences or prose around it
+func parseCommandJSON(text string) (Command, error) {
+	text = cleanMarkdownResponse(text)
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return Command{}, fmt.Errorf("AI response is not a JSON object: %q", text)
+	}
+	object := json.RawMessage(text[start : end+1])
+
+	var completion struct {
+		TaskComplete bool `json:"task_complete"`
+	}
+	if json.Unmarshal(object, &completion) == nil && completion.TaskComplete {
+		return parseTaskComplete(object)
+	}
+	return parseCommandArguments(object)
+}
+
+// parseCommandArguments validates run_command arguments against the schema.
+// Extra fields are ignored, since models like to add an explanation.
+func parseCommandArguments(arguments json.RawMessage) (Command, error) {
+	var command Command
+	if err := json.Unmarshal(arguments, &command); err != nil {
+		return Command{}, fmt.Errorf("invalid run_command arguments %s: %w", arguments, err)
+	}
+	command.Command = strings.TrimSpace(command.Command)
+	if command.Command == "" {
+		return Command{}, errors.New("invalid run_command arguments: command is empty")
+	}
+	if strings.TrimSpace(command.Reasoning) == "" {
+		return Command{}, errors.New("invalid run_command arguments: reasoning is empty")
+	}
+	return command, nil
+}
@@ -0,0 +1,78 @@
+package ai
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// replyProvider answers each chat request with the next of its replies and
+// keeps the messages it was sent
+type replyProvider struct {
+	replies  []string
+	requests [][]Message
+}
+
+func (p *replyProvider) Name() string  { return "reply" }
+func (p *replyProvider) Model() string { return "reply-1" }
+func (p *replyProvider) Capabilities() Capabilities {
+	return Capabilities{Chat: true, ContextWindow: 8000}
+}
+func (p *replyProvider) Complete(ctx context.Context, prompt string, opts Options) (Response, error) {
+	return p.Chat(ctx, []Message{{Role: RoleUser, Content: prompt}}, opts)
+}
+func (p *replyProvider) Chat(ctx context.Context, messages []Message, opts Options) (Response, error) {
+	p.requests = append(p.requests, messages)
+	reply := p.replies[0]
+	if len(p.replies) > 1 {
+		p.replies = p.replies[1:]
+	}
+	return Response{Text: reply}, nil
+}
+
+func genTestCommand(t *testing.T, replies ...string) (*replyProvider, Command, error) {
+	SetToolCalling(true)
+	t.Cleanup(func() { SetToolCalling(false) })
+	provider := &replyProvider{replies: replies}
+	command, err := genCommand(provider, []Message{{Role: RoleUser, Content: "What next?"}})
+	return provider, command, err
+}
+
+func TestCommandIgnoresExtraFields(t *testing.T) {
+	provider, command, err := genTestCommand(t, `{"command": "ls /srv", "reasoning": "look around", "explanation": "extra"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.Command != "ls /srv" || len(provider.requests) != 1 {
+		t.Errorf("got %+v after %d requests", command, len(provider.requests))
+	}
+}
+
+func TestInvalidCommandIsSentBack(t *testing.T) {
+	provider, command, err := genTestCommand(t,
+		`{"command": "ls /srv", "reasoning": ""}`,
+		`{"command": "ls /srv", "reasoning": "look around"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.Command != "ls /srv" || command.Reasoning != "look around" {
+		t.Errorf("got %+v", command)
+	}
+	if len(provider.requests) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(provider.requests))
+	}
+	retry := provider.requests[1]
+	if len(retry) != 3 || retry[1].Role != RoleAssistant || !strings.Contains(retry[2].Content, "reasoning is empty") {
+		t.Errorf("retry did not show the model its reply and the error: %+v", retry)
+	}
+}
+
+func TestInvalidCommandGivesUp(t *testing.T) {
+	provider, _, err := genTestCommand(t, `not json`)
+	if err == nil {
+		t.Fatal("an invalid reply was accepted")
+	}
+	if len(provider.requests) != invalidReplyRetries+1 {
+		t.Errorf("sent %d requests, want %d", len(provider.requests), invalidReplyRetries+1)
+	}
+}
@@ -0,0 +1,275 @@
+package ai
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CallType labels what an AI request was for, for usage accounting
+type CallType string
+
+const (
+	CallNextCommand        CallType = "next-command"
+	CallOutcome            CallType = "outcome"
+	CallChunkSummary       CallType = "chunk-summary"
+	CallSummaryOfSummaries CallType = "summary-of-summaries"
+	CallProgressSummary    CallType = "progress-summary"
+	CallGoalCheck          CallType = "goal-check"
+)
+
+var callTypes = []CallType{CallNextCommand, CallOutcome, CallChunkSummary, CallSummaryOfSummaries, CallProgressSummary, CallGoalCheck}
+
+// prices maps model name prefixes to US dollars per million prompt and
+// completion tokens. More specific prefixes must come first.
+var prices = []struct {
+	prefix     string
+	prompt     float64
+	completion float64
+}{
+	{"gpt-4.1-nano", 0.10, 0.40},
+	{"gpt-4.1-mini", 0.40, 1.60},
+	{"gpt-4.1", 2.00, 8.00},
+	{"gpt-4o-mini", 0.15, 0.60},
+	{"gpt-4o", 2.50, 10.00},
+	{"gpt-4-turbo", 10.00, 30.00},
+	{"gpt-4", 30.00, 60.00},
+	{"gpt-3.5-turbo", 0.50, 1.50},
+	{"o3-mini", 1.10, 4.40},
+	{"o4-mini", 1.10, 4.40},
+	{"claude-3-5-haiku", 0.80, 4.00},
+	{"claude-3-haiku", 0.25, 1.25},
+	{"claude-3-5-sonnet", 3.00, 15.00},
+	{"claude-3-7-sonnet", 3.00, 15.00},
+	{"claude-sonnet-4", 3.00, 15.00},
+	{"claude-3-opus", 15.00, 75.00},
+	{"claude-opus-4", 15.00, 75.00},
+}
+
+// UsageTotals sums the token usage of a set of AI requests
+type UsageTotals struct {
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost_usd"`
+	// EstimatedCalls counts requests whose backend reported no usage, so
+	// their tokens come from CountTokens
+	EstimatedCalls int `json:"estimated_calls,omitempty"`
+}
+
+func (t UsageTotals) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+func (t *UsageTotals) add(usage Usage, cost float64, estimated bool) {
+	t.Calls++
+	t.PromptTokens += usage.PromptTokens
+	t.CompletionTokens += usage.CompletionTokens
+	t.Cost += cost
+	if estimated {
+		t.EstimatedCalls++
+	}
+}
+
+// UsageReport is the token usage of a whole session
+type UsageReport struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	// PriceKnown is false if we have no price for the model, in which case costs are 0
+	PriceKnown  bool                     `json:"price_known"`
+	Total       UsageTotals              `json:"total"`
+	ByCallType  map[CallType]UsageTotals `json:"by_call_type"`
+	ByIteration map[int]UsageTotals      `json:"by_iteration"`
+}
+
+type usageTracker struct {
+	mu         sync.Mutex
+	iteration  int
+	priceSet   bool
+	prompt     float64
+	completion float64
+	report     UsageReport
+}
+
+var usage = &usageTracker{
+	report: UsageReport{
+		ByCallType:  make(map[CallType]UsageTotals),
+		ByIteration: make(map[int]UsageTotals),
+	},
+}
+
+// SetIteration attributes subsequent AI requests to actor iteration n
+func SetIteration(n int) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.iteration = n
+}
+
+// SetPrices overrides the built-in price table, in US dollars per million tokens
+func SetPrices(prompt float64, completion float64) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.priceSet = true
+	usage.prompt = prompt
+	usage.completion = completion
+}
+
+// PriceKnown reports whether costs can be estimated for the provider's model
+func PriceKnown(provider Provider) bool {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	_, _, known := usage.prices(provider)
+	return known
+}
+
+// UsageTotal returns the running total for the session
+func UsageTotal() UsageTotals {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	return usage.report.Total
+}
+
+// SessionUsage returns a copy of the session's usage so far
+func SessionUsage() UsageReport {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	report := usage.report
+	report.ByCallType = make(map[CallType]UsageTotals)
+	for callType, totals := range usage.report.ByCallType {
+		report.ByCallType[callType] = totals
+	}
+	report.ByIteration = make(map[int]UsageTotals)
+	for iteration, totals := range usage.report.ByIteration {
+		report.ByIteration[iteration] = totals
+	}
+	return report
+}
+
+// RestoreUsage continues from the usage of an earlier run of a resumed
+// session, so its budgets and reports cover the whole session
+func RestoreUsage(report UsageReport) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	usage.report = report
+	usage.report.ByCallType = make(map[CallType]UsageTotals)
+	for callType, totals := range report.ByCallType {
+		usage.report.ByCallType[callType] = totals
+	}
+	usage.report.ByIteration = make(map[int]UsageTotals)
+	for iteration, totals := range report.ByIteration {
+		usage.report.ByIteration[iteration] = totals
+	}
+}
+
+// recordUsage adds one request to the session totals. Backends that report no
+// usage are counted with estimates from the prompt and response text.
+func recordUsage(provider Provider, callType CallType, resp Response, prompt string) {
+	estimated := false
+	if resp.Usage.PromptTokens == 0 && resp.Usage.CompletionTokens == 0 {
+		completion := resp.Text
+		for _, call := range resp.ToolCalls {
+			completion += call.Name + string(call.Arguments)
+		}
+		resp.Usage = Usage{
+			PromptTokens:     CountTokens(provider, prompt),
+			CompletionTokens: CountTokens(provider, completion),
+		}
+		estimated = true
+	}
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	promptPrice, completionPrice, known := usage.prices(provider)
+	cost := (float64(resp.Usage.PromptTokens)*promptPrice + float64(resp.Usage.CompletionTokens)*completionPrice) / 1e6
+
+	usage.report.Provider = provider.Name()
+	usage.report.Model = provider.Model()
+	usage.report.PriceKnown = known
+	usage.report.Total.add(resp.Usage, cost, estimated)
+
+	byCallType := usage.report.ByCallType[callType]
+	byCallType.add(resp.Usage, cost, estimated)
+	usage.report.ByCallType[callType] = byCallType
+
+	byIteration := usage.report.ByIteration[usage.iteration]
+	byIteration.add(resp.Usage, cost, estimated)
+	usage.report.ByIteration[usage.iteration] = byIteration
+}
+
+// prices looks up the price per million tokens for the provider's model.
+// Self-hosted backends and the mock are free. Must be called with mu held.
+func (u *usageTracker) prices(provider Provider) (float64, float64, bool) {
+	if u.priceSet {
+		return u.prompt, u.completion, true
+	}
+	if provider.Name() == "local" || provider.Name() == "ollama" || provider.Name() == "mock" {
+		return 0, 0, true
+	}
+	for _, entry := range prices {
+		if strings.HasPrefix(provider.Model(), entry.prefix) {
+			return entry.prompt, entry.completion, true
+		}
+	}
+	return 0, 0, false
+}
+
+// String is the one-line running total shown in the TUI
+func (r UsageReport) String() string {
+	if r.Total.Calls == 0 {
+		return "No AI calls yet"
+	}
+	cost := "cost unknown"
+	if r.PriceKnown {
+		cost = fmt.Sprintf("est. $%.4f", r.Total.Cost)
+	}
+	return fmt.Sprintf("%d AI calls · %d tokens (%d prompt, %d completion) · %s", r.Total.Calls, r.Total.Tokens(), r.Total.PromptTokens, r.Total.CompletionTokens, cost)
+}
+
+// Report renders the usage as a table for the final log
+func (r UsageReport) Report() string {
+	line := func(label string, t UsageTotals) string {
+		estimated := ""
+		if t.EstimatedCalls > 0 {
+			estimated = fmt.Sprintf(" (%d estimated)", t.EstimatedCalls)
+		}
+		return fmt.Sprintf("  %-22s %4d calls %9d prompt %8d completion  $%.4f%s\n", label, t.Calls, t.PromptTokens, t.CompletionTokens, t.Cost, estimated)
+	}
+
+	report := fmt.Sprintf("Token usage for %s %s:\n", r.Provider, r.Model)
+	for _, callType := range callTypes {
+		if totals, ok := r.ByCallType[callType]; ok {
+			report += line(string(callType), totals)
+		}
+	}
+	report += line("total", r.Total)
+
+	var iterations []int
+	for iteration := range r.ByIteration {
+		iterations = append(iterations, iteration)
+	}
+	sort.Ints(iterations)
+	report += "Per iteration:\n"
+	for _, iteration := range iterations {
+		report += line(fmt.Sprintf("iteration %d", iteration), r.ByIteration[iteration])
+	}
+
+	if !r.PriceKnown {
+		report += fmt.Sprintf("No price known for model %s; pass --input-price and --output-price to estimate cost.\n", r.Model)
+	}
+	return report
+}
+
+// WriteFile saves the report as JSON
+func (r UsageReport) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -2,5 +2,7 @@
 [ -f aquarium.log ] && rm aquarium.log && echo "Removed aquarium.log"
 [ -f debug.log ] && rm debug.log && echo "Removed debug.log"
 [ -f terminal.log ] && rm terminal.log && echo "Removed terminal.log"
+[ -f usage.json ] && rm usage.json && echo "Removed usage.json"
+[ -f session.json ] && rm session.json && echo "Removed session.json"
 
 echo "Cleanup complete."
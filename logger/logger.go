@@ -14,6 +14,7 @@ var debug bool
 
 var logFile *os.File
 var logTerminalFile *os.File
+var sessionLogFile *os.File
 
 const (
 	logFilename         = "aquarium.log"
@@ -75,6 +76,43 @@ func Init(_logch chan string, _termch chan string, _debug bool) {
 	}
 }
 
+// InitTemp initializes the logger in a new temporary directory, which becomes
+// the working directory, and discards what would be shown in the TUI. Tests
+// use it to keep the log files out of the tree, removing the directory after.
+func InitTemp() (string, error) {
+	dir, err := os.MkdirTemp("", "aquarium-test-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return "", err
+	}
+
+	logch := make(chan string, 100)
+	termch := make(chan string, 100)
+	go func() {
+		for range logch {
+		}
+	}()
+	go func() {
+		for range termch {
+		}
+	}()
+	Init(logch, termch, false)
+	return dir, nil
+}
+
+// SetSessionLog also appends everything logged with Logf to path, so each
+// session has its own log next to the shared aquarium.log
+func SetSessionLog(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	sessionLogFile = file
+	return nil
+}
+
 // Logf sends the log message along the default logger channel
 // and appends to aquarium.log
 func Logf(msg string, args ...interface{}) {
@@ -89,6 +127,11 @@ func Logf(msg string, args ...interface{}) {
 	if err != nil {
 		logch <- fmt.Sprintf("Error writing to log file: %s", err)
 	}
+	if sessionLogFile != nil {
+		if _, err := sessionLogFile.WriteString(msgFormatted); err != nil {
+			logch <- fmt.Sprintf("Error writing to session log file: %s", err)
+		}
+	}
 }
 
 // LogTerminalf sends the log message along a different channel
@@ -1,13 +1,19 @@
 package main
 
 import (
+	_ "embed"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"aquarium/actor"
+	"aquarium/ai"
 	"aquarium/logger"
+	"aquarium/sandbox"
 
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
@@ -22,18 +28,33 @@ type AppendContentMsg struct {
 	terminalContent string
 }
 
-const gap = 8
+// UsageMsg carries the latest token usage summary for the status line
+type UsageMsg string
+
+const (
+	gap             = 8
+	usageFilename   = "usage.json"
+	sessionFilename = "session.json"
+)
 
 type model struct {
 	logContent      string
 	terminalContent string
+	usage           string
 	ready           bool
 	viewportLeft    viewport.Model
 	viewportRight   viewport.Model
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	return tickUsage()
+}
+
+// tickUsage refreshes the usage status line every second
+func tickUsage() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg {
+		return UsageMsg(ai.SessionUsage().String())
+	})
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -49,27 +70,31 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 	case tea.WindowSizeMsg:
 		headerHeight := lipgloss.Height(m.headerView())
+		footerHeight := lipgloss.Height(m.statusView())
 
 		width := msg.Width/2 - gap
 		if !m.ready {
-			m.viewportLeft = viewport.New(width, msg.Height-headerHeight)
+			m.viewportLeft = viewport.New(width, msg.Height-headerHeight-footerHeight)
 			m.viewportLeft.YPosition = headerHeight
-			m.viewportRight = viewport.New(width, msg.Height-headerHeight)
+			m.viewportRight = viewport.New(width, msg.Height-headerHeight-footerHeight)
 			m.viewportRight.YPosition = headerHeight
 			m.viewportLeft.YPosition = headerHeight + 1
 			m.viewportRight.YPosition = headerHeight + 1
 			m.ready = true
 		} else {
 			m.viewportLeft.Width = width
-			m.viewportLeft.Height = msg.Height - headerHeight
+			m.viewportLeft.Height = msg.Height - headerHeight - footerHeight
 			m.viewportRight.Width = width
-			m.viewportRight.Height = msg.Height - headerHeight
+			m.viewportRight.Height = msg.Height - headerHeight - footerHeight
 		}
 		wrappedContentLeft := wordwrap.String(m.logContent, width)
 		m.viewportLeft.SetContent(wrappedContentLeft)
 
 		wrappedContentRight := wrap.String(m.terminalContent, width)
 		m.viewportRight.SetContent(wrappedContentRight)
+	case UsageMsg:
+		m.usage = string(msg)
+		cmds = append(cmds, tickUsage())
 	case AppendContentMsg:
 		//logger.Debugf("Recieved msg. msg.logContent: %s; msg.terminalContent: %s\n\n", msg.logContent, msg.terminalContent)
 
@@ -104,7 +129,13 @@ func (m model) View() string {
 
 	vpleft := fmt.Sprintf("%s\n%s", m.headerView(), m.viewportLeft.View())
 	vpright := fmt.Sprintf("%s\n%s", m.headerView(), m.viewportRight.View())
-	return lipgloss.JoinHorizontal(lipgloss.Center, vpleft, strings.Repeat(" ", gap), vpright)
+	panes := lipgloss.JoinHorizontal(lipgloss.Center, vpleft, strings.Repeat(" ", gap), vpright)
+	return lipgloss.JoinVertical(lipgloss.Left, panes, m.statusView())
+}
+
+// statusView is the running token usage and cost, shown below the panes
+func (m model) statusView() string {
+	return lipgloss.NewStyle().Faint(true).Render(m.usage)
 }
 
 func (m model) headerView() string {
@@ -119,7 +150,82 @@ func max(a, b int) int {
 	return b
 }
 
+// headerFlags collects repeated --header flags
+type headerFlags struct {
+	values map[string]string
+}
+
+func (h *headerFlags) String() string {
+	var headers []string
+	for name, value := range h.values {
+		headers = append(headers, name+": "+value)
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h *headerFlags) Set(header string) error {
+	name, value, found := strings.Cut(header, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be in the form 'Name: value'")
+	}
+	if h.values == nil {
+		h.values = make(map[string]string)
+	}
+	h.values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	return nil
+}
+
+// dockerfile builds the default sandbox image when it's missing
+//
+//go:embed Dockerfile
+var dockerfile []byte
+
+func newDockerSandbox(runtimeName string, configPath string, rebuildImage bool, keepSnapshots bool) (*sandbox.Docker, error) {
+	cfg := sandbox.DefaultDockerConfig()
+	if configPath != "" {
+		var err error
+		cfg, err = sandbox.LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Image == sandbox.DefaultDockerConfig().Image {
+		cfg.Dockerfile = dockerfile
+		cfg.RebuildImage = rebuildImage
+	} else if rebuildImage {
+		return nil, fmt.Errorf("--rebuild-image only applies to the default image, not '%s'", cfg.Image)
+	}
+	runtime, err := sandbox.DetectRuntime(runtimeName)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Runtime = runtime
+	cfg.KeepSnapshots = keepSnapshots
+	return sandbox.NewDocker(cfg)
+}
+
 func main() {
+	// the namespace sandbox re-executes this binary as the sandbox's init process
+	sandbox.RunNamespaceInit()
+
+	// `aquarium fork <id> --at <step> [flags]` continues another session from
+	// one of its snapshots, and `aquarium resume <id> [flags]` picks a stopped
+	// session back up
+	args := os.Args[1:]
+	var forkOf, resumeID string
+	if len(args) > 0 && (args[0] == "fork" || args[0] == "resume") {
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			fmt.Printf("Usage: aquarium %s <session id> [flags]\n", args[0])
+			os.Exit(1)
+		}
+		if args[0] == "fork" {
+			forkOf = args[1]
+		} else {
+			resumeID = args[1]
+		}
+		args = args[2:]
+	}
+
 	goal := flag.String("goal", "Your goal is to run a Minecraft server.",
 		`Goal to give the AI. This will be injected within the following statement:
 
@@ -130,7 +236,7 @@ func main() {
 > Respond with a linux command to give to the server.
 `)
 	debug := flag.Bool("debug", false, "Enable logging of AI prompts to debug.log")
-	preserveContainer := flag.Bool("preserve-container", false, "Persist docker container after program completes.")
+	preserveContainer := flag.Bool("preserve-container", false, "Persist docker container after program completes, e.g. to continue it with aquarium resume <id>. Has no effect on the namespace sandbox, which ends with the program.")
 	iterationLimit := flag.Int("limit", 30, "Maximum number of commands the AI should run.")
 	commandTimeout := flag.Int("command-timeout", 60, "Maximum time in seconds to wait for a command to finish before force-killing it. Set to 0 to disable timeout.")
 	contextMode := flag.String("context-mode", "partial",
@@ -138,21 +244,190 @@ func main() {
 - partial: We send the last 100 lines of the terminal output to the AI. (cheap, accurate)
 - full: We send the entire terminal output to the AI. (expensive, very accurate)
 `)
-	aiModel := flag.String("model", "gpt-4.1-nano", "OpenAI model to use. Ignored if --url is provided. See https://platform.openai.com/docs/models")
-	url := flag.String("url", "", "URL to locally hosted endpoint. If provided, this supersedes the --model flag.")
+	conversation := flag.Bool("conversation", false, "Send the command history as a multi-turn conversation (system prompt, then alternating commands and outcomes) instead of one large prompt. Works best with chat models and lets providers cache the prompt prefix.")
+	aiModel := flag.String("model", "", "Model to use. Defaults to gpt-4.1-nano for openai and claude-3-5-haiku-latest for anthropic; required for ollama. See https://platform.openai.com/docs/models")
+	url := flag.String("url", "", "Base URL of a locally hosted endpoint, e.g. http://localhost:8000. With --provider anthropic, overrides the API base URL.")
+	localEndpoint := flag.String("local-endpoint", "completions",
+		`Which API to use on the --url server:
+- completions: /v1/completions with an instruction-style prompt
+- chat: /v1/chat/completions with chat messages
+`)
+	var headers headerFlags
+	flag.Var(&headers, "header", "Extra HTTP header sent to the --url server, as 'Name: value'. Can be repeated, e.g. for auth.")
+	maxRetries := flag.Int("max-retries", 5, "How many times to retry an AI request that failed with a transient error (rate limit, server error, timeout). Set to 0 to disable retries.")
+	retryMaxDelay := flag.Int("retry-max-delay", 60, "Maximum time in seconds to wait between retries. A Retry-After header from the server takes precedence.")
+	inputPrice := flag.Float64("input-price", 0, "Price in US dollars per million prompt tokens, for cost estimates. Overrides the built-in price table when set together with --output-price.")
+	outputPrice := flag.Float64("output-price", 0, "Price in US dollars per million completion tokens, for cost estimates.")
+	contextWindow := flag.Int("context-window", 0, "Context size of the model in tokens. Older command history is summarized once the prompt nears this size. Prompt sizes are exact for OpenAI models and approximate for others. Defaults to a per-model value (4096 for unknown models).")
+	maxTokens := flag.Int("max-tokens", 0, "Stop the session once the AI calls have used this many tokens in total. Set to 0 for no limit.")
+	maxCost := flag.Float64("max-cost", 0, "Stop the session once the estimated cost of AI calls reaches this many US dollars. Needs a known price for the model, or --input-price and --output-price. Set to 0 for no limit.")
+	maxDuration := flag.Duration("max-duration", 0, "Stop the session after this much wall-clock time, e.g. 30m. Set to 0 for no limit.")
+	script := flag.String("script", "", "YAML script for --provider mock: a list of commands to run in order, regex rules mapping prompts to canned responses, and a default outcome.")
+	verify := flag.String("verify", "", "Shell command run in the container after every command and when the AI says it is done, e.g. 'curl -sf localhost:25565'. Exit code 0 means the goal is achieved and ends the session. Its result is written to session.json.")
+	checkGoal := flag.Bool("check-goal", false, "After every command, ask the AI whether the goal has been achieved, and end the session if so. Costs one extra AI call per command.")
+	tools := flag.Bool("tools", false, "Ask the AI for each command as a structured run_command tool call with its reasoning, instead of free text. Allows multi-line commands such as heredocs. Providers without tool calling are asked for a JSON object instead.")
+	record := flag.String("record", "", "Write every AI request and response to this JSONL cassette file, for replaying the run later with --replay.")
+	replay := flag.String("replay", "", "Answer AI requests from a cassette written with --record instead of calling the provider. No network access or API key is needed.")
+	replayMatch := flag.String("replay-match", ai.ReplayByHash, "How --replay finds the response for a request: 'hash' matches the exact prompt, 'order' serves responses in recorded order even if prompts differ.")
+	sandboxName := flag.String("sandbox", "docker",
+		`Where the AI's commands run:
+- docker: A container from the aquarium image, on the aquarium network.
+- namespace: Linux namespaces over a throwaway overlay of --rootfs. Needs no Docker daemon, but has no network access.
+`)
+	runtimeName := flag.String("runtime", sandbox.RuntimeAuto, "Container engine for --sandbox docker: 'docker', 'podman' (rootful or rootless, through its Docker-compatible API) or 'auto' to use whichever socket is found. DOCKER_HOST and CONTAINER_HOST override the socket paths.")
+	rebuildImage := flag.Bool("rebuild-image", false, "Build the aquarium image from scratch before starting, e.g. after changing the Dockerfile. It is otherwise built only when missing.")
+	configPath := flag.String("config", "", "YAML session config for --sandbox docker: image, memory, cpus, pids_limit, disk, cap_add, security_opt, env, dns, network_mode (e.g. none) and user. See the README.")
+	rootfs := flag.String("rootfs", "", "Root filesystem directory for --sandbox namespace, e.g. an exported aquarium image. It is never modified.")
+	snapshotEvery := flag.Int("snapshot-every", 0, "Snapshot the sandbox before every Nth command (docker commit, or an overlay checkpoint for --sandbox namespace). Set to 0 to disable snapshots.")
+	keepSnapshots := flag.Bool("keep-snapshots", false, "Keep the session's snapshots after it ends and record them in sessions/<id>/steps.jsonl, so it can be forked with aquarium fork or resumed from a snapshot. They are otherwise removed with the sandbox. Snapshots before every command unless --snapshot-every is set.")
+	rollback := flag.Bool("rollback", false, "Restore the last snapshot when a destructive command (rm -rf, apt remove, dd, ...) fails, or when the --verify exit code goes up, and tell the AI the step was reverted. Snapshots before every command unless --snapshot-every is set.")
+	resumeEnded := flag.Bool("resume-ended", false, "For aquarium resume <id>, also resume a session that already ended, e.g. with status limit-reached or failed. Without it only sessions that stopped while running are resumed.")
+	at := flag.Int("at", -1, "For aquarium fork <id>, the step to fork the session from, i.e. the number of commands it had run. It must have taken a snapshot there, see sessions/<id>/steps.jsonl.")
+	requestTimeout := flag.Int("request-timeout", 300, "Maximum time in seconds to wait for a single AI request. Set to 0 to disable timeout.")
+	providerName := flag.String("provider", "",
+		`Which LLM backend to use:
+- openai: OpenAI chat completions API. Requires OPENAI_API_KEY.
+- local: A locally hosted completion endpoint such as llama-cpp-python.
+- anthropic: Anthropic Messages API. Requires ANTHROPIC_API_KEY.
+- ollama: Ollama's native API at --url or OLLAMA_HOST (default http://localhost:11434). Run without --model to list available models.
+- mock: Answers from the YAML file given with --script. No API key or network needed.
+Defaults to 'local' if --url is provided, 'openai' otherwise.
+`)
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	if *contextMode != "partial" && *contextMode != "full" {
 		fmt.Println("Invalid context-mode. Must be 'partial' or 'full'.")
 	}
 
+	if *providerName == "" {
+		if *url != "" {
+			*providerName = "local"
+		} else {
+			*providerName = "openai"
+		}
+	}
+
+	provider, err := ai.NewProvider(ai.Config{
+		Provider:      *providerName,
+		Model:         *aiModel,
+		URL:           *url,
+		Endpoint:      *localEndpoint,
+		Headers:       headers.values,
+		Timeout:       time.Duration(*requestTimeout) * time.Second,
+		ContextWindow: *contextWindow,
+		MaxRetries:    *maxRetries,
+		RetryMaxDelay: time.Duration(*retryMaxDelay) * time.Second,
+		Record:        *record,
+		Replay:        *replay,
+		ReplayMatch:   *replayMatch,
+		Script:        *script,
+	})
+	if err != nil {
+		fmt.Println("Could not set up AI provider:", err)
+		os.Exit(1)
+	}
+
+	ai.SetToolCalling(*tools)
+
+	if *inputPrice > 0 || *outputPrice > 0 {
+		ai.SetPrices(*inputPrice, *outputPrice)
+	}
+	if *maxCost > 0 && !ai.PriceKnown(provider) {
+		fmt.Printf("--max-cost needs a price for model %s. Pass --input-price and --output-price.\n", provider.Model())
+		os.Exit(1)
+	}
+
+	if (*rollback || *keepSnapshots) && *snapshotEvery == 0 {
+		*snapshotEvery = 1
+	}
+
+	goalSet := false
+	flag.Visit(func(f *flag.Flag) {
+		goalSet = goalSet || f.Name == "goal"
+	})
+
+	var fork *actor.Step
+	if forkOf != "" {
+		if *at < 0 {
+			fmt.Println("aquarium fork needs --at <step>")
+			os.Exit(1)
+		}
+		step, err := actor.LoadStep(forkOf, *at)
+		if err != nil {
+			fmt.Println("Could not fork session:", err)
+			os.Exit(1)
+		}
+		fork = &step
+		if !goalSet {
+			*goal = step.Goal
+		}
+	} else if *at >= 0 {
+		fmt.Println("--at only applies to aquarium fork")
+		os.Exit(1)
+	}
+
+	var resume *actor.State
+	if resumeID != "" {
+		state, err := actor.LoadState(resumeID)
+		if err != nil {
+			fmt.Println("Could not resume session:", err)
+			os.Exit(1)
+		}
+		if state.Status != actor.StatusRunning && !*resumeEnded {
+			fmt.Printf("Session %s already ended with status '%s'. Pass --resume-ended to resume it anyway.\n", resumeID, state.Status)
+			os.Exit(1)
+		}
+		resume = &state
+		if !goalSet {
+			*goal = state.Goal
+		}
+	} else if *resumeEnded {
+		fmt.Println("--resume-ended only applies to aquarium resume")
+		os.Exit(1)
+	}
+
+	id := actor.NewID()
+	if resume != nil {
+		id = resume.ID
+	}
+	sessionDir := actor.SessionDir(id)
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		fmt.Println("Could not create session directory:", err)
+		os.Exit(1)
+	}
+	var sb sandbox.Sandbox
+	switch *sandboxName {
+	case "docker":
+		sb, err = newDockerSandbox(*runtimeName, *configPath, *rebuildImage, *keepSnapshots)
+	case "namespace":
+		if *configPath != "" {
+			err = fmt.Errorf("--config only applies to --sandbox docker")
+			break
+		}
+		cfg := sandbox.NamespaceConfig{Rootfs: *rootfs}
+		if *keepSnapshots {
+			cfg.SnapshotDir = filepath.Join(sessionDir, "snapshots")
+		}
+		sb, err = sandbox.NewNamespace(cfg)
+	default:
+		err = fmt.Errorf("unknown sandbox '%s', must be 'docker' or 'namespace'", *sandboxName)
+	}
+	if err != nil {
+		fmt.Println("Could not set up sandbox:", err)
+		os.Exit(1)
+	}
+
 	logch := make(chan string, 10000)  // general log messages; each one is appended (with newline)
 	termch := make(chan string, 10000) // terminal log messages; each one completely replaces the previous
 	logger.Init(logch, termch, *debug)
+	if err := logger.SetSessionLog(filepath.Join(sessionDir, "aquarium.log")); err != nil {
+		fmt.Println("Could not create session log:", err)
+		os.Exit(1)
+	}
 
 	p := tea.NewProgram(
-		model{logContent: "", terminalContent: string("Container not started.")},
+		model{logContent: "", terminalContent: string("Container not started."), usage: ai.SessionUsage().String()},
 		tea.WithAltScreen(),
 	)
 
@@ -169,23 +444,67 @@ func main() {
 		}
 	}()
 
-	go func() {
-		if *url != "" {
-			*aiModel = "local"
-		}
+	act := actor.NewActor(provider, sb, actor.Config{
+		Goal:                  *goal,
+		ContextMode:           *contextMode,
+		IterationLimit:        *iterationLimit,
+		CommandTimeoutSeconds: *commandTimeout,
+		Conversation:          *conversation,
+		CheckGoal:             *checkGoal,
+		VerifyCommand:         *verify,
+		MaxTokens:             *maxTokens,
+		MaxCost:               *maxCost,
+		MaxDuration:           *maxDuration,
+		SnapshotEvery:         *snapshotEvery,
+		KeepSnapshots:         *keepSnapshots,
+		Rollback:              *rollback,
+		ID:                    id,
+		SessionDir:            sessionDir,
+		Fork:                  fork,
+		Resume:                resume,
+	})
+
+	// the reports are written when the session ends, or when the TUI is quit
+	// while it is still running, whichever comes first
+	var reportOnce sync.Once
+	writeReports := func() {
+		reportOnce.Do(func() {
+			usage := ai.SessionUsage()
+			logger.Logf("%s", usage.Report())
+			for _, path := range []string{usageFilename, filepath.Join(sessionDir, usageFilename)} {
+				if err := usage.WriteFile(path); err != nil {
+					logger.Logf("Error writing usage report: %s\n", err)
+				}
+			}
 
-		actor := actor.NewActor(*aiModel, *url, *goal, *contextMode, *iterationLimit, *commandTimeout)
-		<-actor.Loop()
+			result := act.Result()
+			if result.Status == actor.StatusRunning {
+				result.Reason = fmt.Sprintf("quit while running. Continue it with aquarium resume %s", id)
+			}
+			logger.Logf("%s\n", result)
+			for _, path := range []string{sessionFilename, filepath.Join(sessionDir, sessionFilename)} {
+				if err := result.WriteFile(path); err != nil {
+					logger.Logf("Error writing session summary: %s\n", err)
+				}
+			}
+		})
+	}
+
+	go func() {
+		<-act.Loop()
 		if !*preserveContainer {
-			err := actor.CleanupContainer()
+			err := act.Cleanup()
 			if err != nil {
-				logger.Logf("Error cleaning up container: %s", err)
+				logger.Logf("Error cleaning up sandbox: %s\n", err)
 			}
 		}
+		writeReports()
 		logger.Logf("Done.\n")
 	}()
 
-	if _, err := p.Run(); err != nil {
+	_, err = p.Run()
+	writeReports()
+	if err != nil {
 		fmt.Println("could not run program:", err)
 		os.Exit(1)
 	}
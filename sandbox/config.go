@@ -0,0 +1,78 @@
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultDockerConfig is the container built from the Dockerfile, on the aquarium network
+func DefaultDockerConfig() DockerConfig {
+	return DockerConfig{
+		Image:       "aquarium",
+		NetworkMode: "aquarium",
+		User:        "ubuntu",
+		SecurityOpt: []string{"apparmor:unconfined"},
+	}
+}
+
+// LoadConfig reads a session config file, e.g.
+//
+//	image: debian:12
+//	memory: 2g
+//	cpus: 1.5
+//	pids_limit: 512
+//	disk: 10g
+//	network_mode: none
+//	user: root
+//	env:
+//	  LANG: C.UTF-8
+//
+// Settings it leaves out keep their DefaultDockerConfig values.
+func LoadConfig(path string) (DockerConfig, error) {
+	cfg := DefaultDockerConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("could not read config: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg DockerConfig) validate() error {
+	if cfg.Image == "" {
+		return fmt.Errorf("image is empty")
+	}
+	if cfg.User == "" {
+		return fmt.Errorf("user is empty")
+	}
+	if cfg.Memory != "" {
+		if _, err := units.RAMInBytes(cfg.Memory); err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+	}
+	if cfg.Disk != "" {
+		if _, err := units.RAMInBytes(cfg.Disk); err != nil {
+			return fmt.Errorf("disk: %w", err)
+		}
+	}
+	if cfg.CPUs < 0 {
+		return fmt.Errorf("cpus must not be negative")
+	}
+	if cfg.PidsLimit < 0 {
+		return fmt.Errorf("pids_limit must not be negative")
+	}
+	return nil
+}
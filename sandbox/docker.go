@@ -0,0 +1,390 @@
+package sandbox
+
+import (
+	"aquarium/logger"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+)
+
+// ubuntuUID is the uid of the ubuntu user created by the Dockerfile
+const ubuntuUID = 1000
+
+// DockerConfig holds the settings for a Docker sandbox, as read by LoadConfig
+type DockerConfig struct {
+	// Image needs bash and script(1), and su unless User is root
+	Image string `yaml:"image"`
+	// NetworkMode is a network name, or "none", "bridge" or "host"
+	NetworkMode string `yaml:"network_mode"`
+	// User is who the AI's shell and the verification command run as
+	User string `yaml:"user"`
+	// Memory and Disk are sizes such as "512m" or "10g". Disk limits the
+	// container's writable layer, which only some storage drivers support.
+	Memory      string            `yaml:"memory"`
+	Disk        string            `yaml:"disk"`
+	CPUs        float64           `yaml:"cpus"`
+	PidsLimit   int64             `yaml:"pids_limit"`
+	CapAdd      []string          `yaml:"cap_add"`
+	SecurityOpt []string          `yaml:"security_opt"`
+	Env         map[string]string `yaml:"env"`
+	DNS         []string          `yaml:"dns"`
+
+	// Runtime is the engine to talk to, from DetectRuntime. Docker's default socket when empty.
+	Runtime Runtime `yaml:"-"`
+	// Dockerfile builds Image when it's missing. Without one, Image is pulled.
+	Dockerfile []byte `yaml:"-"`
+	// RebuildImage builds Image from Dockerfile even if it exists
+	RebuildImage bool `yaml:"-"`
+	// KeepSnapshots leaves snapshot images behind on Destroy, e.g. so the
+	// session can be forked later
+	KeepSnapshots bool `yaml:"-"`
+}
+
+// Docker runs the sandbox as a container, using the image built from the
+// Dockerfile. It works with Podman too, through its Docker-compatible API.
+type Docker struct {
+	cli         *client.Client
+	cfg         DockerConfig
+	containerId string
+
+	// found out from the engine on Start
+	podman   bool
+	rootless bool
+
+	snapshots []string
+}
+
+func NewDocker(cfg DockerConfig) (*Docker, error) {
+	opts := []client.Opt{client.WithVersion("1.41")}
+	if cfg.Runtime.Host != "" {
+		opts = append(opts, client.WithHost(cfg.Runtime.Host))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{cli: cli, cfg: cfg}, nil
+}
+
+func (d *Docker) Start(ctx context.Context) error {
+	if err := d.detectEngine(ctx); err != nil {
+		return err
+	}
+	if err := d.ensureImage(ctx); err != nil {
+		return err
+	}
+	return d.create(ctx, d.cfg.Image)
+}
+
+// Reattach takes over a container left behind by an earlier run, e.g. with
+// --preserve-container, starting it again if it has stopped
+func (d *Docker) Reattach(ctx context.Context, id string) error {
+	if err := d.detectEngine(ctx); err != nil {
+		return err
+	}
+	info, err := d.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return fmt.Errorf("looking for container %s: %w", id, err)
+	}
+	if !info.State.Running {
+		if err := d.cli.ContainerStart(ctx, info.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf("starting container %s: %w", id, err)
+		}
+	}
+	d.containerId = info.ID
+	return nil
+}
+
+// create starts a new container from image, which becomes the sandbox's container
+func (d *Docker) create(ctx context.Context, image string) error {
+	hostConfig, err := d.hostConfig()
+	if err != nil {
+		return err
+	}
+	if d.rootless {
+		// rootless engines can't load AppArmor profiles, so leave theirs alone
+		hostConfig.SecurityOpt = nil
+	}
+	if d.podman && d.rootless {
+		// run the ubuntu user as the invoking user, so it needs no subordinate
+		// uid range and owns what it creates on the host
+		hostConfig.UsernsMode = container.UsernsMode(fmt.Sprintf("keep-id:uid=%d,gid=%d", ubuntuUID, ubuntuUID))
+	}
+	if hostConfig.NetworkMode != "" && hostConfig.NetworkMode.IsUserDefined() {
+		mode, err := d.ensureNetwork(ctx, string(hostConfig.NetworkMode))
+		if err != nil {
+			return err
+		}
+		hostConfig.NetworkMode = container.NetworkMode(mode)
+	}
+
+	var env []string
+	for name, value := range d.cfg.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	resp, err := d.cli.ContainerCreate(ctx,
+		&container.Config{
+			Image: image,
+			User:  "root",
+			Env:   env,
+			Cmd:   []string{"tail", "-f", "/dev/null"}, // wait indefinitely
+		},
+		hostConfig, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("creating container: %w", err)
+	}
+	d.containerId = resp.ID
+
+	// podman attaches the container to its NetworkMode already, and refuses a second time
+	if hostConfig.NetworkMode.IsUserDefined() && hostConfig.NetworkMode != "" && !d.podman {
+		if err := d.cli.NetworkConnect(ctx, string(hostConfig.NetworkMode), resp.ID, nil); err != nil {
+			return fmt.Errorf("connecting container to network '%s': %w", hostConfig.NetworkMode, err)
+		}
+	}
+	if err := d.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("starting container: %w", err)
+	}
+	return nil
+}
+
+// hostConfig applies the resource limits and network settings
+func (d *Docker) hostConfig() (*container.HostConfig, error) {
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(d.cfg.NetworkMode),
+		SecurityOpt: d.cfg.SecurityOpt,
+		CapAdd:      d.cfg.CapAdd,
+		DNS:         d.cfg.DNS,
+	}
+	if d.cfg.Memory != "" {
+		memory, err := units.RAMInBytes(d.cfg.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("memory: %w", err)
+		}
+		hostConfig.Memory = memory
+		hostConfig.MemorySwap = memory // no swap on top
+	}
+	if d.cfg.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(d.cfg.CPUs * 1e9)
+	}
+	if d.cfg.PidsLimit > 0 {
+		hostConfig.PidsLimit = &d.cfg.PidsLimit
+	}
+	if d.cfg.Disk != "" {
+		hostConfig.StorageOpt = map[string]string{"size": d.cfg.Disk}
+	}
+	return hostConfig, nil
+}
+
+// detectEngine asks the engine whether it is Podman and whether it runs rootless
+func (d *Docker) detectEngine(ctx context.Context) error {
+	version, err := d.cli.ServerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", d.runtimeName(), err)
+	}
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			d.podman = true
+		}
+	}
+
+	info, err := d.cli.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", d.runtimeName(), err)
+	}
+	for _, option := range info.SecurityOptions {
+		if strings.Contains(option, "name=rootless") {
+			d.rootless = true
+		}
+	}
+	if d.podman || d.rootless {
+		logger.Logf("Container engine: podman=%t, rootless=%t\n", d.podman, d.rootless)
+	}
+	return nil
+}
+
+func (d *Docker) runtimeName() string {
+	if d.cfg.Runtime.Name == "" {
+		return RuntimeDocker
+	}
+	return d.cfg.Runtime.Name
+}
+
+func (d *Docker) ID() string {
+	return d.containerId
+}
+
+func (d *Docker) Exec(ctx context.Context, opts ExecOptions) (ExecResult, error) {
+	user, dir := opts.User, opts.WorkingDir
+	if opts.AsAgent {
+		user, dir = d.cfg.User, homeDir(d.cfg.User)
+	}
+	if user == "" {
+		// with keep-id, podman would otherwise run it as the ubuntu user
+		user = "root"
+	}
+	execConfig, err := d.cli.ContainerExecCreate(ctx, d.containerId, types.ExecConfig{
+		User:         user,
+		WorkingDir:   dir,
+		Cmd:          opts.Cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	attachment, err := d.cli.ContainerExecAttach(ctx, execConfig.ID, types.ExecStartCheck{})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer attachment.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, attachment.Reader)
+	if err != nil {
+		return ExecResult{}, err
+	}
+
+	inspect, err := d.cli.ContainerExecInspect(ctx, execConfig.ID)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return ExecResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: inspect.ExitCode}, nil
+}
+
+func (d *Docker) AttachTTY(ctx context.Context, opts TTYOptions) (io.ReadWriteCloser, error) {
+	execConfig, err := d.cli.ContainerExecCreate(ctx, d.containerId, types.ExecConfig{
+		Tty:          true,
+		User:         "root",
+		Cmd:          []string{"/bin/bash"},
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := d.cli.ContainerExecAttach(ctx, execConfig.ID, types.ExecStartCheck{Tty: true})
+	if err != nil {
+		return nil, err
+	}
+
+	// initialize terminal. The environment is given on the script command line,
+	// which stays out of the transcript, and only reaches the bash script
+	// records, so the shells above it never run the actor's PROMPT_COMMAND.
+	init := ""
+	if d.cfg.User != "root" {
+		init += fmt.Sprintf("su %s\n", d.cfg.User)
+	}
+	init += "cd\n"
+	init += "env"
+	for _, env := range opts.Env {
+		init += " " + ShellQuote(env)
+	}
+	init += " script -f /tmp/out -c /bin/bash\n" // write all terminal output to file /tmp/out
+	if _, err := connection.Conn.Write([]byte(init)); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return &hijackedTTY{connection}, nil
+}
+
+func (d *Docker) ReadTranscript(ctx context.Context) (string, error) {
+	// we discard stderr here. we are using script(1) which records everything to stdout
+	result, err := d.Exec(ctx, ExecOptions{Cmd: []string{"cat", "/tmp/out"}})
+	if err != nil {
+		return "", err
+	}
+	return stripEscapes(result.Stdout), nil
+}
+
+// Snapshot commits the container to an image
+func (d *Docker) Snapshot(ctx context.Context, name string) (string, error) {
+	resp, err := d.cli.ContainerCommit(ctx, d.containerId, types.ContainerCommitOptions{
+		Reference: fmt.Sprintf("%s:%s", snapshotRepository(d.cfg.Image), name),
+		Pause:     true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("committing container: %w", err)
+	}
+	d.snapshots = append(d.snapshots, resp.ID)
+	return resp.ID, nil
+}
+
+// Restore replaces the container with a new one started from a snapshot
+func (d *Docker) Restore(ctx context.Context, ref string) error {
+	old := d.containerId
+	if err := d.create(ctx, ref); err != nil {
+		return fmt.Errorf("restoring snapshot: %w", err)
+	}
+	return d.cli.ContainerRemove(ctx, old, types.ContainerRemoveOptions{Force: true})
+}
+
+// Destroy removes the container and the snapshots taken of it
+func (d *Docker) Destroy(ctx context.Context) error {
+	if d.containerId == "" {
+		return nil
+	}
+	err := d.cli.ContainerRemove(ctx, d.containerId, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		return err
+	}
+	if d.cfg.KeepSnapshots {
+		return nil
+	}
+	for _, snapshot := range d.snapshots {
+		_, err := d.cli.ImageRemove(ctx, snapshot, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+		if err != nil {
+			return fmt.Errorf("removing snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// hijackedTTY reads and writes the terminal exec's stream
+type hijackedTTY struct {
+	types.HijackedResponse
+}
+
+func (t *hijackedTTY) Read(p []byte) (int, error) {
+	return t.Reader.Read(p)
+}
+
+func (t *hijackedTTY) Write(p []byte) (int, error) {
+	return t.Conn.Write(p)
+}
+
+func (t *hijackedTTY) Close() error {
+	t.HijackedResponse.Close()
+	return nil
+}
+
+// snapshotRepository names the images snapshots are committed to, e.g. aquarium-snapshot
+func snapshotRepository(image string) string {
+	repository := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository = image[:i]
+	}
+	return repository + "-snapshot"
+}
+
+// homeDir is where a user's shell starts, going by the usual layout
+func homeDir(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
@@ -0,0 +1,239 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-memory sandbox for exercising the actor without containers.
+// Each line typed into its terminal is answered by Shell.
+type Fake struct {
+	// Shell runs a line typed into the terminal. Nil echoes nothing and exits 0.
+	Shell func(line string) (output string, exitCode int)
+	// ExecFunc answers Exec. Nil succeeds with no output.
+	ExecFunc func(opts ExecOptions) (ExecResult, error)
+	// Prompt is written to the terminal after each line, as a shell prompt
+	// would be. Nil writes "$ " after the marker the actor's PROMPT_COMMAND
+	// prints, so the actor sees each line's exit code.
+	Prompt func(exitCode int) string
+
+	mu         sync.Mutex
+	started    bool
+	destroyed  bool
+	transcript strings.Builder
+	execs      []ExecOptions
+	snapshots  []string
+	restores   []string
+	ttyEnv     []string
+	tty        *fakeTTY
+}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+func (f *Fake) Start(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started {
+		return errors.New("sandbox already started")
+	}
+	f.started = true
+	return nil
+}
+
+func (f *Fake) ID() string {
+	return "fake"
+}
+
+func (f *Fake) Exec(ctx context.Context, opts ExecOptions) (ExecResult, error) {
+	f.mu.Lock()
+	if !f.started || f.destroyed {
+		f.mu.Unlock()
+		return ExecResult{}, errors.New("sandbox is not running")
+	}
+	f.execs = append(f.execs, opts)
+	f.mu.Unlock()
+
+	if f.ExecFunc == nil {
+		return ExecResult{}, nil
+	}
+	return f.ExecFunc(opts)
+}
+
+func (f *Fake) AttachTTY(ctx context.Context, opts TTYOptions) (io.ReadWriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.started || f.destroyed {
+		return nil, errors.New("sandbox is not running")
+	}
+	f.tty = newFakeTTY(f)
+	f.ttyEnv = opts.Env
+	// the Docker transcript starts with the header written by script(1)
+	f.transcript.WriteString("Script started [COMMAND=/bin/bash]\n" + f.prompt(0))
+	f.tty.output.WriteString(f.prompt(0))
+	return f.tty, nil
+}
+
+func (f *Fake) ReadTranscript(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.destroyed {
+		return "", errors.New("sandbox is not running")
+	}
+	return stripEscapes(f.transcript.String()), nil
+}
+
+func (f *Fake) Snapshot(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.snapshots = append(f.snapshots, name)
+	return fmt.Sprintf("fake-snapshot-%d", len(f.snapshots)), nil
+}
+
+func (f *Fake) Restore(ctx context.Context, ref string) error {
+	f.mu.Lock()
+	tty := f.tty
+	f.tty = nil
+	f.transcript.Reset()
+	f.restores = append(f.restores, ref)
+	f.mu.Unlock()
+	if tty != nil {
+		tty.Close()
+	}
+	return nil
+}
+
+func (f *Fake) Destroy(ctx context.Context) error {
+	f.mu.Lock()
+	tty := f.tty
+	f.destroyed = true
+	f.mu.Unlock()
+	if tty != nil {
+		tty.Close()
+	}
+	return nil
+}
+
+// Execs returns the commands run with Exec so far
+func (f *Fake) Execs() []ExecOptions {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ExecOptions{}, f.execs...)
+}
+
+// Snapshots returns the names of the snapshots taken so far
+func (f *Fake) Snapshots() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.snapshots...)
+}
+
+// TTYEnv returns the environment the last terminal was attached with
+func (f *Fake) TTYEnv() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.ttyEnv...)
+}
+
+// Restores returns the snapshot references restored so far
+func (f *Fake) Restores() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.restores...)
+}
+
+// run answers one line typed into the terminal and returns what the terminal shows
+func (f *Fake) run(line string) string {
+	output, exitCode := "", 0
+	if f.Shell != nil {
+		output, exitCode = f.Shell(line)
+	}
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+
+	// like a terminal, the transcript shows the typed line after the prompt
+	shown := output + f.prompt(exitCode)
+	f.mu.Lock()
+	fmt.Fprintf(&f.transcript, "%s\n%s", line, shown)
+	f.mu.Unlock()
+	return shown
+}
+
+func (f *Fake) prompt(exitCode int) string {
+	if f.Prompt == nil {
+		return fmt.Sprintf("\x1b]777;aquarium-done;%d\x07$ ", exitCode)
+	}
+	return f.Prompt(exitCode)
+}
+
+// fakeTTY buffers what the fake shell prints until it is read, so writes never
+// wait on the reader
+type fakeTTY struct {
+	sandbox *Fake
+	mu      sync.Mutex
+	cond    *sync.Cond
+	input   []byte
+	output  bytes.Buffer
+	closed  bool
+}
+
+func newFakeTTY(sandbox *Fake) *fakeTTY {
+	t := &fakeTTY{sandbox: sandbox}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+func (t *fakeTTY) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.output.Len() == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if t.output.Len() == 0 {
+		return 0, io.EOF
+	}
+	return t.output.Read(p)
+}
+
+func (t *fakeTTY) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	t.input = append(t.input, p...)
+	var lines []string
+	for {
+		i := bytes.IndexByte(t.input, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, string(t.input[:i]))
+		t.input = t.input[i+1:]
+	}
+	t.mu.Unlock()
+
+	for _, line := range lines {
+		shown := t.sandbox.run(line)
+		t.mu.Lock()
+		t.output.WriteString(shown)
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (t *fakeTTY) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
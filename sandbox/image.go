@@ -0,0 +1,143 @@
+package sandbox
+
+import (
+	"aquarium/logger"
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// ensureImage builds the image from the Dockerfile, or pulls it if there is
+// none, unless it is already there
+func (d *Docker) ensureImage(ctx context.Context) error {
+	if !d.cfg.RebuildImage {
+		_, _, err := d.cli.ImageInspectWithRaw(ctx, d.cfg.Image)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("looking for image '%s': %w", d.cfg.Image, err)
+		}
+	}
+
+	if d.cfg.Dockerfile == nil {
+		logger.Logf("Pulling image '%s'...\n", d.cfg.Image)
+		progress, err := d.cli.ImagePull(ctx, d.cfg.Image, types.ImagePullOptions{})
+		if err != nil {
+			return fmt.Errorf("pulling image '%s': %w", d.cfg.Image, err)
+		}
+		defer progress.Close()
+		return logProgress(progress, "pull")
+	}
+
+	logger.Logf("Building image '%s'. This takes a few minutes the first time...\n", d.cfg.Image)
+	buildContext, err := tarDockerfile(d.cfg.Dockerfile)
+	if err != nil {
+		return err
+	}
+	resp, err := d.cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        []string{d.cfg.Image},
+		Dockerfile:  "Dockerfile",
+		Remove:      true,
+		ForceRemove: true,
+		NoCache:     d.cfg.RebuildImage,
+		PullParent:  d.cfg.RebuildImage,
+	})
+	if err != nil {
+		return fmt.Errorf("building image '%s': %w", d.cfg.Image, err)
+	}
+	defer resp.Body.Close()
+	if err := logProgress(resp.Body, "build"); err != nil {
+		return fmt.Errorf("building image '%s': %w", d.cfg.Image, err)
+	}
+	logger.Logf("Built image '%s'\n", d.cfg.Image)
+	return nil
+}
+
+// ensureNetwork creates the container's network if it's a named one that doesn't
+// exist yet, and returns the network mode to use. Rootless engines fall back
+// to their default network when they can't create it.
+func (d *Docker) ensureNetwork(ctx context.Context, mode string) (string, error) {
+	_, err := d.cli.NetworkInspect(ctx, mode, types.NetworkInspectOptions{})
+	if err == nil {
+		return mode, nil
+	}
+	if !client.IsErrNotFound(err) {
+		return "", fmt.Errorf("looking for network '%s': %w", mode, err)
+	}
+
+	logger.Logf("Creating network '%s'\n", mode)
+	_, err = d.cli.NetworkCreate(ctx, mode, types.NetworkCreate{CheckDuplicate: true})
+	if err == nil {
+		return mode, nil
+	}
+	if d.rootless {
+		logger.Logf("Could not create network '%s' (%s). Using the rootless default network instead.\n", mode, err)
+		return "", nil
+	}
+	return "", fmt.Errorf("creating network '%s': %w", mode, err)
+}
+
+// tarDockerfile wraps a Dockerfile in the tar archive the build API expects
+func tarDockerfile(dockerfile []byte) (io.Reader, error) {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	header := &tar.Header{
+		Name:    "Dockerfile",
+		Mode:    0644,
+		Size:    int64(len(dockerfile)),
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := archive.Write(dockerfile); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// logProgress logs the engine's build or pull output line by line, and
+// returns the error it reports, if any
+func logProgress(stream io.Reader, prefix string) error {
+	decoder := json.NewDecoder(stream)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if message.Error != nil {
+			return errors.New(message.Error.Message)
+		}
+		if message.ErrorMessage != "" {
+			return errors.New(message.ErrorMessage)
+		}
+
+		text := message.Stream
+		if text == "" && message.Progress == nil {
+			// per-layer pull status, skipping the progress bar updates
+			text = strings.TrimSpace(message.ID + " " + message.Status)
+		}
+		for _, line := range strings.Split(text, "\n") {
+			if strings.TrimSpace(line) != "" {
+				logger.Logf("[%s] %s\n", prefix, strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+}
@@ -0,0 +1,407 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// namespaceInitArg is argv[0] when this binary is re-executed as a sandbox's init process
+	namespaceInitArg   = "aquarium-sandbox-init"
+	namespaceDirEnv    = "AQUARIUM_SANDBOX_DIR"
+	namespaceRootfsEnv = "AQUARIUM_SANDBOX_ROOTFS"
+
+	namespaceSocket     = "control.sock"
+	namespaceTranscript = "transcript"
+	namespaceHostname   = "aquarium"
+	namespaceHome       = "/root"
+)
+
+// namespaceEnv is the environment of every process started in the sandbox
+var namespaceEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=" + namespaceHome,
+	"DEBIAN_FRONTEND=noninteractive",
+}
+
+// initRequest is sent by the host to the init process, one per connection
+type initRequest struct {
+	// Type is "exec" to run a command to completion, or "tty" to start a shell
+	// on a terminal, after which the connection carries the terminal's stream
+	Type string   `json:"type"`
+	Cmd  []string `json:"cmd,omitempty"`
+	Dir  string   `json:"dir,omitempty"`
+	Env  []string `json:"env,omitempty"`
+}
+
+type execReply struct {
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RunNamespaceInit takes over the process if it was started as the init of a
+// namespace sandbox, and does nothing otherwise. Call it first thing in main.
+func RunNamespaceInit() {
+	if len(os.Args) == 0 || os.Args[0] != namespaceInitArg {
+		return
+	}
+	ready := os.NewFile(3, "ready")
+	server, err := setupNamespace(os.Getenv(namespaceDirEnv), os.Getenv(namespaceRootfsEnv))
+	if err != nil {
+		fmt.Fprintf(ready, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(ready, "ready\n")
+	ready.Close()
+	server.serve()
+	os.Exit(0)
+}
+
+// setupNamespace mounts the overlay rootfs with fresh /proc and /dev, makes it
+// the root, and opens the control socket and transcript in the host's dir
+func setupNamespace(dir string, rootfs string) (*initServer, error) {
+	if dir == "" || rootfs == "" {
+		return nil, errors.New("sandbox init started without a directory or rootfs")
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return nil, fmt.Errorf("making mounts private: %w", err)
+	}
+
+	merged := filepath.Join(dir, "merged")
+	// userxattr keeps overlay's own xattrs under user., the only namespace an
+	// unprivileged mount can write
+	overlay := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", rootfs, filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+	if err := unix.Mount("overlay", merged, "overlay", 0, overlay); err != nil {
+		return nil, fmt.Errorf("mounting overlay (unprivileged overlay mounts need Linux 5.11 or later): %w", err)
+	}
+	if err := setupSpecialFilesystems(merged); err != nil {
+		return nil, err
+	}
+	if err := unix.Sethostname([]byte(namespaceHostname)); err != nil {
+		return nil, fmt.Errorf("setting hostname: %w", err)
+	}
+	if err := loopbackUp(); err != nil {
+		return nil, fmt.Errorf("bringing up loopback: %w", err)
+	}
+
+	// opened before the host's filesystem goes out of reach
+	transcript, err := os.OpenFile(filepath.Join(dir, namespaceTranscript), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// a socket left by the init process before a Restore
+	os.Remove(filepath.Join(dir, namespaceSocket))
+	listener, err := net.Listen("unix", filepath.Join(dir, namespaceSocket))
+	if err != nil {
+		return nil, err
+	}
+
+	// stack the new root on top of the old one and detach the old one, which
+	// needs no directory for it in the rootfs
+	if err := os.Chdir(merged); err != nil {
+		return nil, err
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return nil, fmt.Errorf("switching root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return nil, fmt.Errorf("detaching old root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return nil, err
+	}
+
+	os.Clearenv()
+	for _, env := range namespaceEnv {
+		name, value, _ := strings.Cut(env, "=")
+		os.Setenv(name, value)
+	}
+
+	return &initServer{
+		listener:   listener,
+		transcript: transcript,
+		waiting:    make(map[int]chan syscall.WaitStatus),
+	}, nil
+}
+
+func setupSpecialFilesystems(root string) error {
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"proc", "proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+		{"tmpfs", "dev", "tmpfs", unix.MS_NOSUID, "mode=755"},
+		{"devpts", "dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+		{"tmpfs", "dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=1777"},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(root, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := unix.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("mounting /%s: %w", m.target, err)
+		}
+	}
+
+	// device nodes can't be created in a user namespace, so bind the host's
+	for _, device := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		target := filepath.Join(root, "dev", device)
+		file, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		if err := unix.Mount("/dev/"+device, target, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("binding /dev/%s: %w", device, err)
+		}
+	}
+
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, "dev", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return err
+	}
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq)
+}
+
+// initServer answers the host's requests. As PID 1 it also reaps every
+// process in the sandbox, so it starts processes itself rather than through
+// os/exec, whose Wait would race with the reaping.
+type initServer struct {
+	listener   net.Listener
+	transcript *os.File
+
+	mu      sync.Mutex
+	waiting map[int]chan syscall.WaitStatus
+}
+
+func (s *initServer) serve() {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go s.reap(sigchld)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *initServer) reap(sigchld chan os.Signal) {
+	for range sigchld {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			s.mu.Lock()
+			if exited, ok := s.waiting[pid]; ok {
+				exited <- status
+				delete(s.waiting, pid)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// start starts a process and returns a channel that receives its exit status
+func (s *initServer) start(path string, args []string, attr *os.ProcAttr) (*os.Process, chan syscall.WaitStatus, error) {
+	// held until the process is registered, so the reaper can't miss it
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	process, err := os.StartProcess(path, args, attr)
+	if err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan syscall.WaitStatus, 1)
+	s.waiting[process.Pid] = exited
+	return process, exited, nil
+}
+
+func (s *initServer) handle(conn net.Conn) {
+	defer conn.Close()
+	line, err := readLine(conn)
+	if err != nil {
+		return
+	}
+	var req initRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		json.NewEncoder(conn).Encode(execReply{Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	switch req.Type {
+	case "exec":
+		json.NewEncoder(conn).Encode(s.exec(req))
+	case "tty":
+		if err := s.tty(conn, req); err != nil {
+			json.NewEncoder(conn).Encode(execReply{Error: err.Error()})
+		}
+	default:
+		json.NewEncoder(conn).Encode(execReply{Error: fmt.Sprintf("unknown request type '%s'", req.Type)})
+	}
+}
+
+func (s *initServer) exec(req initRequest) execReply {
+	if len(req.Cmd) == 0 {
+		return execReply{Error: "no command given"}
+	}
+	path, err := exec.LookPath(req.Cmd[0])
+	if err != nil {
+		return execReply{Error: err.Error()}
+	}
+	dir := req.Dir
+	if dir == "" {
+		dir = namespaceHome
+	}
+
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return execReply{Error: err.Error()}
+	}
+	defer stdin.Close()
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return execReply{Error: err.Error()}
+	}
+	defer stdoutReader.Close()
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutWriter.Close()
+		return execReply{Error: err.Error()}
+	}
+	defer stderrReader.Close()
+
+	process, exited, err := s.start(path, req.Cmd, &os.ProcAttr{
+		Dir:   dir,
+		Env:   append(append([]string{}, namespaceEnv...), req.Env...),
+		Files: []*os.File{stdin, stdoutWriter, stderrWriter},
+	})
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		return execReply{Error: err.Error()}
+	}
+	defer process.Release()
+
+	stderr := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(stderrReader)
+		stderr <- data
+	}()
+	stdout, _ := io.ReadAll(stdoutReader)
+	reply := execReply{Stdout: string(stdout), Stderr: string(<-stderr)}
+	reply.ExitCode = exitCode(<-exited)
+	return reply
+}
+
+// tty starts a shell on a new pseudo-terminal and connects it to conn. All
+// terminal output is also appended to the transcript, as `script -f` would.
+func (s *initServer) tty(conn net.Conn, req initRequest) error {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		return fmt.Errorf("unlocking pty: %w", err)
+	}
+	ptyNumber, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		return fmt.Errorf("getting pty number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNumber), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+
+	env := append(append([]string{}, namespaceEnv...), "TERM=xterm")
+	process, exited, err := s.start("/bin/bash", []string{"/bin/bash"}, &os.ProcAttr{
+		Dir:   namespaceHome,
+		Env:   append(env, req.Env...),
+		Files: []*os.File{slave, slave, slave},
+		Sys:   &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0},
+	})
+	slave.Close()
+	if err != nil {
+		return err
+	}
+	defer process.Release()
+
+	if err := json.NewEncoder(conn).Encode(execReply{}); err != nil {
+		process.Kill()
+		return nil
+	}
+
+	go func() {
+		io.Copy(master, conn)
+		// the host hung up
+		syscall.Kill(-process.Pid, syscall.SIGHUP)
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			s.transcript.Write(buf[:n])
+			conn.Write(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	<-exited
+	return nil
+}
+
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
@@ -0,0 +1,539 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespaceStartTimeout bounds how long the init process may take to set up the sandbox
+const namespaceStartTimeout = 10 * time.Second
+
+// NamespaceConfig holds the settings for a namespace sandbox
+type NamespaceConfig struct {
+	// Rootfs is an extracted root filesystem, e.g. from `docker export`. It is
+	// never modified: changes go to a throwaway overlay.
+	Rootfs string
+	// SnapshotDir is where snapshots are written. They are kept after Destroy
+	// when it's set, and removed with the sandbox otherwise.
+	SnapshotDir string
+}
+
+// Namespace runs the sandbox as a process tree in its own user, mount, PID,
+// network, UTS and IPC namespaces over an overlay of Rootfs, without a
+// container daemon. The user namespace maps only the invoking user, as root,
+// so everything in the sandbox runs as root and ExecOptions.User is ignored.
+// The network namespace has only a loopback interface.
+type Namespace struct {
+	cfg    NamespaceConfig
+	dir    string // holds the overlay's upper and work dirs, the transcript and the control socket
+	init   *exec.Cmd
+	exited chan struct{} // closed once the init process has exited
+}
+
+func NewNamespace(cfg NamespaceConfig) (*Namespace, error) {
+	if cfg.Rootfs == "" {
+		return nil, errors.New("the namespace sandbox needs a --rootfs")
+	}
+	rootfs, err := filepath.Abs(cfg.Rootfs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "bin", "bash")); err != nil {
+		return nil, fmt.Errorf("rootfs %s has no /bin/bash: %w", rootfs, err)
+	}
+	cfg.Rootfs = rootfs
+	if cfg.SnapshotDir != "" {
+		// snapshot refs are paths to the tarballs, so make them absolute
+		if cfg.SnapshotDir, err = filepath.Abs(cfg.SnapshotDir); err != nil {
+			return nil, err
+		}
+	}
+	return &Namespace{cfg: cfg}, nil
+}
+
+func (n *Namespace) Start(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "aquarium-sandbox-")
+	if err != nil {
+		return err
+	}
+	n.dir = dir
+	for _, sub := range []string{"upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	return n.launch(ctx)
+}
+
+// launch starts the init process, which mounts the overlay and serves requests
+func (n *Namespace) launch(ctx context.Context) error {
+	// the init process reports on this pipe once the sandbox is ready, or why it isn't
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	var stderr bytes.Buffer
+	n.init = &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{namespaceInitArg},
+		Env:        []string{namespaceDirEnv + "=" + n.dir, namespaceRootfsEnv + "=" + n.cfg.Rootfs},
+		Stderr:     &stderr,
+		ExtraFiles: []*os.File{readyWriter},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+				syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+			Pdeathsig:   syscall.SIGKILL,
+		},
+	}
+	err = n.init.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("starting sandbox init: %w", err)
+	}
+	n.exited = make(chan struct{})
+	go func() {
+		n.init.Wait()
+		close(n.exited)
+	}()
+
+	status := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(ready).ReadString('\n')
+		status <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-status:
+		if line == "ready" {
+			return nil
+		}
+		if line == "" {
+			// init died before saying why, so look at what it printed
+			<-n.exited
+			line = strings.TrimSpace(stderr.String())
+		}
+		return fmt.Errorf("setting up sandbox: %s", line)
+	case <-n.exited:
+		return fmt.Errorf("setting up sandbox: %s", strings.TrimSpace(stderr.String()))
+	case <-time.After(namespaceStartTimeout):
+		return errors.New("setting up sandbox: timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Namespace) ID() string {
+	if n.init == nil || n.init.Process == nil {
+		return ""
+	}
+	return fmt.Sprintf("pid-%d", n.init.Process.Pid)
+}
+
+func (n *Namespace) Exec(ctx context.Context, opts ExecOptions) (ExecResult, error) {
+	conn, err := n.request(ctx, initRequest{Type: "exec", Cmd: opts.Cmd, Dir: opts.WorkingDir})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer conn.Close()
+
+	var reply execReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return ExecResult{}, fmt.Errorf("reading exec result: %w", err)
+	}
+	if reply.Error != "" {
+		return ExecResult{}, errors.New(reply.Error)
+	}
+	return ExecResult{Stdout: reply.Stdout, Stderr: reply.Stderr, ExitCode: reply.ExitCode}, nil
+}
+
+func (n *Namespace) AttachTTY(ctx context.Context, opts TTYOptions) (io.ReadWriteCloser, error) {
+	conn, err := n.request(ctx, initRequest{Type: "tty", Env: opts.Env})
+	if err != nil {
+		return nil, err
+	}
+	// the reply is followed by the raw terminal stream, so read no further than it
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("attaching terminal: %w", err)
+	}
+	var reply execReply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("attaching terminal: %w", err)
+	}
+	if reply.Error != "" {
+		conn.Close()
+		return nil, errors.New(reply.Error)
+	}
+	return conn, nil
+}
+
+func (n *Namespace) ReadTranscript(ctx context.Context) (string, error) {
+	if !n.running() {
+		return "", errors.New("sandbox is not running")
+	}
+	data, err := os.ReadFile(filepath.Join(n.dir, namespaceTranscript))
+	if err != nil {
+		return "", err
+	}
+	return stripEscapes(string(data)), nil
+}
+
+// Snapshot archives the overlay's upper dir, which holds every change made to
+// the rootfs, to a tarball in SnapshotDir or the sandbox's directory
+func (n *Namespace) Snapshot(ctx context.Context, name string) (string, error) {
+	dir := n.cfg.SnapshotDir
+	if dir == "" {
+		dir = filepath.Join(n.dir, "snapshots")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".tar")
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// like docker commit's pause, so background processes can't change files mid-walk
+	thaw, err := n.freeze()
+	defer thaw()
+	if err != nil {
+		return "", fmt.Errorf("pausing sandbox: %w", err)
+	}
+
+	archive := tar.NewWriter(file)
+	upper := filepath.Join(n.dir, "upper")
+	err = filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed by a process that got away before the freeze
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(upper, path); err != nil {
+			return err
+		}
+		// overlay keeps opaque directories, which hide the rootfs's copy, in xattrs
+		header.PAXRecords, err = overlayXattrs(path)
+		if err != nil {
+			return err
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		contents, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+		_, err = io.Copy(archive, contents)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("archiving sandbox changes: %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Restore replaces the overlay's upper dir with a snapshot's and starts a
+// new init process on it
+func (n *Namespace) Restore(ctx context.Context, ref string) error {
+	n.stop()
+	for _, sub := range []string{"upper", "work"} {
+		if err := os.RemoveAll(filepath.Join(n.dir, sub)); err != nil {
+			return err
+		}
+		if err := os.Mkdir(filepath.Join(n.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	if err := extractSnapshot(ref, filepath.Join(n.dir, "upper")); err != nil {
+		return fmt.Errorf("restoring snapshot: %w", err)
+	}
+	return n.launch(ctx)
+}
+
+// Destroy kills the init process, which takes every process in the sandbox
+// and its mounts with it, then removes the sandbox's directory
+func (n *Namespace) Destroy(ctx context.Context) error {
+	n.stop()
+	if n.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(n.dir)
+}
+
+// freeze stops every process in the sandbox but init with SIGSTOP, and
+// returns a function that continues them. Processes forked meanwhile are
+// caught by scanning again until there are no new ones.
+func (n *Namespace) freeze() (func(), error) {
+	var stopped []int
+	thaw := func() {
+		for _, pid := range stopped {
+			syscall.Kill(pid, syscall.SIGCONT)
+		}
+	}
+	if !n.running() {
+		return thaw, nil
+	}
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", n.init.Process.Pid))
+	if err != nil {
+		return thaw, err
+	}
+
+	seen := map[int]bool{n.init.Process.Pid: true}
+	for {
+		entries, err := os.ReadDir("/proc")
+		if err != nil {
+			return thaw, err
+		}
+		var pids []int
+		for _, entry := range entries {
+			if pid, err := strconv.Atoi(entry.Name()); err == nil && !seen[pid] {
+				pids = append(pids, pid)
+			}
+		}
+		// parents first, mostly, so a shell doesn't see its job stop
+		sort.Ints(pids)
+		found := false
+		for _, pid := range pids {
+			if ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err != nil || ns != namespace {
+				continue
+			}
+			seen[pid] = true
+			if syscall.Kill(pid, syscall.SIGSTOP) == nil {
+				stopped = append(stopped, pid)
+				found = true
+			}
+		}
+		if !found {
+			return thaw, nil
+		}
+	}
+}
+
+// stop kills the init process and waits for it
+func (n *Namespace) stop() {
+	if n.exited != nil {
+		n.init.Process.Kill()
+		<-n.exited
+	}
+}
+
+func (n *Namespace) running() bool {
+	if n.exited == nil {
+		return false
+	}
+	select {
+	case <-n.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// overlayXattrs returns the overlay xattrs of path as tar PAX records
+func overlayXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		// e.g. a filesystem without xattrs, where overlay can't have set any
+		return nil, nil
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]string{}
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if !strings.Contains(name, ".overlay.") {
+			continue
+		}
+		length, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, length)
+		length, err = unix.Lgetxattr(path, name, value)
+		if err != nil {
+			return nil, err
+		}
+		records["SCHILY.xattr."+name] = string(value[:length])
+	}
+	return records, nil
+}
+
+// extractSnapshot unpacks a snapshot archive into an empty upper dir
+func extractSnapshot(path string, upper string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := tar.NewReader(file)
+	var dirs []*tar.Header
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(upper, header.Name)
+		if !strings.HasPrefix(target, filepath.Clean(upper)) {
+			return fmt.Errorf("snapshot entry %s is outside the sandbox", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// permissions are set once the directory is filled
+			if header.Name != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			contents, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(contents, archive)
+			contents.Close()
+			if err != nil {
+				return err
+			}
+			if err := setAttributes(target, header); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeChar:
+			// overlay whiteouts, which mark files deleted from the rootfs.
+			// Linux 5.8 and later let anyone create these.
+			dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+			if err := unix.Mknod(target, unix.S_IFCHR|uint32(header.Mode&0777), int(dev)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// deepest first, so a read-only directory doesn't stop its children's updates
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setAttributes(filepath.Join(upper, dirs[i].Name), dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAttributes restores the permissions, times and overlay xattrs of a file or directory
+func setAttributes(path string, header *tar.Header) error {
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, "SCHILY.xattr."); name != key {
+			if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Chmod(path, os.FileMode(header.Mode&0777)|modeBits(header.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, header.ModTime, header.ModTime)
+}
+
+// modeBits converts the setuid, setgid and sticky bits of a tar mode to Go's
+func modeBits(mode int64) os.FileMode {
+	var bits os.FileMode
+	if mode&04000 != 0 {
+		bits |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		bits |= os.ModeSticky
+	}
+	return bits
+}
+
+// request connects to the init process and sends it a request
+func (n *Namespace) request(ctx context.Context, req initRequest) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", filepath.Join(n.dir, namespaceSocket))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to sandbox: %w", err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readLine reads up to a newline one byte at a time, so nothing after it is consumed
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package sandbox
+
+import "errors"
+
+// NamespaceConfig holds the settings for a namespace sandbox
+type NamespaceConfig struct {
+	Rootfs      string
+	SnapshotDir string
+}
+
+// Namespace is only available on Linux
+type Namespace struct {
+	Sandbox
+}
+
+func NewNamespace(cfg NamespaceConfig) (*Namespace, error) {
+	return nil, errors.New("the namespace sandbox needs Linux")
+}
+
+// RunNamespaceInit does nothing outside Linux
+func RunNamespaceInit() {}
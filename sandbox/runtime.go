@@ -0,0 +1,80 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Container runtimes for DetectRuntime. Both are reached through the Docker API.
+const (
+	RuntimeAuto   = "auto"
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// Runtime is a container engine's API socket
+type Runtime struct {
+	Name string
+	// Host is the API address, e.g. unix:///run/user/1000/podman/podman.sock
+	Host string
+}
+
+// DetectRuntime finds the API socket of the named runtime. DOCKER_HOST (for
+// docker) and CONTAINER_HOST (for podman) take precedence over the usual
+// socket paths. With "auto", Docker is preferred when both are present.
+func DetectRuntime(name string) (Runtime, error) {
+	var candidates []Runtime
+	switch name {
+	case RuntimeDocker:
+		candidates = dockerSockets()
+	case RuntimePodman:
+		candidates = podmanSockets()
+	case RuntimeAuto:
+		candidates = append(dockerSockets(), podmanSockets()...)
+	default:
+		return Runtime{}, fmt.Errorf("unknown runtime '%s', must be 'docker', 'podman' or 'auto'", name)
+	}
+
+	var tried []string
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate.Host, "unix://") {
+			// e.g. tcp:// from the environment, which can't be checked up front
+			return candidate, nil
+		}
+		path := strings.TrimPrefix(candidate.Host, "unix://")
+		if _, err := os.Stat(path); err == nil {
+			return candidate, nil
+		}
+		tried = append(tried, path)
+	}
+	if name == RuntimeAuto {
+		name = "docker or podman"
+	}
+	return Runtime{}, fmt.Errorf("no %s socket found, tried %s", name, strings.Join(tried, ", "))
+}
+
+func dockerSockets() []Runtime {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return []Runtime{{RuntimeDocker, host}}
+	}
+	sockets := []Runtime{{RuntimeDocker, "unix:///var/run/docker.sock"}}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		// rootless docker
+		sockets = append(sockets, Runtime{RuntimeDocker, "unix://" + filepath.Join(dir, "docker.sock")})
+	}
+	return sockets
+}
+
+func podmanSockets() []Runtime {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return []Runtime{{RuntimePodman, host}}
+	}
+	var sockets []Runtime
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		// rootless podman, from `systemctl --user enable --now podman.socket`
+		sockets = append(sockets, Runtime{RuntimePodman, "unix://" + filepath.Join(dir, "podman", "podman.sock")})
+	}
+	return append(sockets, Runtime{RuntimePodman, "unix:///run/podman/podman.sock"})
+}
@@ -0,0 +1,74 @@
+package sandbox
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ansiEscape matches the terminal escapes stripped from transcripts, as ansi2txt does
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// Sandbox is an isolated machine the actor runs commands in
+type Sandbox interface {
+	// Start creates and starts the sandbox
+	Start(ctx context.Context) error
+	// ID identifies the sandbox, e.g. the container id
+	ID() string
+	// Exec runs a command to completion outside the terminal
+	Exec(ctx context.Context, opts ExecOptions) (ExecResult, error)
+	// AttachTTY starts the interactive shell the AI types into. Everything
+	// written to it is recorded in the transcript.
+	AttachTTY(ctx context.Context, opts TTYOptions) (io.ReadWriteCloser, error)
+	// ReadTranscript returns the terminal output so far, as plain text
+	ReadTranscript(ctx context.Context) (string, error)
+	// Snapshot saves the sandbox's filesystem under name and returns a reference to it
+	Snapshot(ctx context.Context, name string) (string, error)
+	// Restore puts the filesystem back as it was in a snapshot. Running
+	// processes and the terminal are not kept, so attach a new terminal after.
+	Restore(ctx context.Context, ref string) error
+	// Destroy stops the sandbox and removes it
+	Destroy(ctx context.Context) error
+}
+
+// Reattacher is a Sandbox that can outlive the process, so a resumed session
+// can take over the one it left behind instead of calling Start
+type Reattacher interface {
+	// Reattach uses the existing sandbox with the given ID
+	Reattach(ctx context.Context, id string) error
+}
+
+// ExecOptions describes a command run with Exec
+type ExecOptions struct {
+	Cmd []string
+	// User and WorkingDir default to the sandbox's own defaults when empty
+	User       string
+	WorkingDir string
+	// AsAgent runs the command as the user of the AI's shell, in their home
+	// directory, overriding User and WorkingDir
+	AsAgent bool
+}
+
+// ExecResult is the outcome of a command run with Exec
+type ExecResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// TTYOptions configures the shell started by AttachTTY
+type TTYOptions struct {
+	// Env is exported in the shell before the transcript starts, as KEY=value
+	Env []string
+}
+
+// ShellQuote wraps s in single quotes for bash, so it is passed on as it is
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// stripEscapes turns raw terminal output into plain text
+func stripEscapes(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}